@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// Rules changed on another replica or directly in the database apply after this long
+	accessReloadInterval = 30 * time.Second
+
+	accessAllow = "allow"
+	accessDeny  = "deny"
+)
+
+// accessRule allows or denies an ip address or range, an api key id or an osu! user id
+type accessRule struct {
+	ID        int64     `json:"id"`
+	Kind      string    `json:"kind"`
+	Value     string    `json:"value"`
+	Action    string    `json:"action"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// accessSet is one side of the rules, prepared so checks don't have to touch the database
+type accessSet struct {
+	networks []*net.IPNet
+	keys     map[string]bool // by key hash
+	users    map[int64]bool
+}
+
+func newAccessSet() accessSet {
+	return accessSet{keys: make(map[string]bool), users: make(map[int64]bool)}
+}
+
+func (s *accessSet) hasIP(ip net.IP) bool {
+	for _, network := range s.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type accessList struct {
+	mu    sync.RWMutex
+	allow accessSet
+	deny  accessSet
+}
+
+var accessRules = &accessList{allow: newAccessSet(), deny: newAccessSet()}
+
+func validateAccessRule(rule *accessRule) error {
+	if rule.Action != accessAllow && rule.Action != accessDeny {
+		return fmt.Errorf("action has to be allow or deny")
+	}
+
+	rule.Value = strings.TrimSpace(rule.Value)
+	switch rule.Kind {
+	case "ip":
+		if _, err := parseNetwork(rule.Value); err != nil {
+			return fmt.Errorf("invalid ip or cidr range %v. %v", rule.Value, err)
+		}
+	case "key", "user":
+		if _, err := strconv.ParseInt(rule.Value, 10, 64); err != nil {
+			return fmt.Errorf("invalid %v id %v", rule.Kind, rule.Value)
+		}
+	default:
+		return fmt.Errorf("kind has to be ip, key or user")
+	}
+
+	return nil
+}
+
+func listAccessRules(db *sql.DB) ([]accessRule, error) {
+	rows, err := db.Query("SELECT id, kind, value, action, reason, created_at FROM access_rules ORDER BY id")
+	if err != nil {
+		return nil, fmt.Errorf("error querying database. %v", err)
+	}
+	defer rows.Close()
+
+	rules := []accessRule{}
+	for rows.Next() {
+		var rule accessRule
+		if err = rows.Scan(&rule.ID, &rule.Kind, &rule.Value, &rule.Action, &rule.Reason, &rule.CreatedAt); err != nil {
+			return nil, fmt.Errorf("couldn't scan access rule %v", err)
+		}
+		rules = append(rules, rule)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading access rules. %v", err)
+	}
+
+	return rules, nil
+}
+
+func saveAccessRule(db *sql.DB, rule *accessRule) error {
+	if err := validateAccessRule(rule); err != nil {
+		return err
+	}
+
+	err := db.QueryRow("INSERT INTO access_rules (kind, value, action, reason) VALUES ($1, $2, $3, $4) "+
+		"ON CONFLICT (kind, value) DO UPDATE SET action = EXCLUDED.action, reason = EXCLUDED.reason RETURNING id, created_at",
+		rule.Kind, rule.Value, rule.Action, rule.Reason).Scan(&rule.ID, &rule.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("error saving access rule. %v", err)
+	}
+
+	return nil
+}
+
+func deleteAccessRule(db *sql.DB, id int64) error {
+	res, err := db.Exec("DELETE FROM access_rules WHERE id = $1", id)
+	if err != nil {
+		return fmt.Errorf("error deleting access rule. %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("no such access rule")
+	}
+
+	return nil
+}
+
+// reload replaces the rules in memory with the ones in the database
+func (al *accessList) reload(db *sql.DB) error {
+	rules, err := listAccessRules(db)
+	if err != nil {
+		return err
+	}
+
+	allow, deny := newAccessSet(), newAccessSet()
+	for _, rule := range rules {
+		set := &deny
+		if rule.Action == accessAllow {
+			set = &allow
+		}
+
+		switch rule.Kind {
+		case "ip":
+			network, err := parseNetwork(rule.Value)
+			if err != nil {
+				logger.WithError(err).WithField("rule_id", rule.ID).Warn("Skipping invalid access rule")
+				continue
+			}
+			set.networks = append(set.networks, network)
+		case "user":
+			id, _ := strconv.ParseInt(rule.Value, 10, 64)
+			set.users[id] = true
+		}
+	}
+
+	// Keys are matched by hash, which includes all keys of listed users so they can be checked before auth
+	rows, err := db.Query("SELECT k.key_hash, r.action FROM access_rules r JOIN api_keys k ON " +
+		"(r.kind = 'key' AND k.id::TEXT = r.value) OR (r.kind = 'user' AND k.user_id::TEXT = r.value)")
+	if err != nil {
+		return fmt.Errorf("error querying database. %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash, action string
+		if err = rows.Scan(&hash, &action); err != nil {
+			return fmt.Errorf("couldn't scan key rule %v", err)
+		}
+		if action == accessAllow {
+			allow.keys[hash] = true
+		} else {
+			deny.keys[hash] = true
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("error reading key rules. %v", err)
+	}
+
+	al.mu.Lock()
+	al.allow, al.deny = allow, deny
+	al.mu.Unlock()
+
+	return nil
+}
+
+// Allow rules take precedence, so a single address can be let through a denied range
+func (al *accessList) ipDenied(ip net.IP) bool {
+	al.mu.RLock()
+	defer al.mu.RUnlock()
+
+	return !al.allow.hasIP(ip) && al.deny.hasIP(ip)
+}
+
+func (al *accessList) keyDenied(keyHash string) bool {
+	al.mu.RLock()
+	defer al.mu.RUnlock()
+
+	return !al.allow.keys[keyHash] && al.deny.keys[keyHash]
+}
+
+func (al *accessList) userDenied(userID int64) bool {
+	al.mu.RLock()
+	defer al.mu.RUnlock()
+
+	return !al.allow.users[userID] && al.deny.users[userID]
+}
+
+func reloadAccessRulesRoutine(ctx context.Context, db *sql.DB) {
+	for sleepContext(ctx, accessReloadInterval) {
+		if err := accessRules.reload(db); err != nil {
+			logger.WithError(err).Error("Error reloading access rules")
+		}
+	}
+}
+
+func denyAccess(c *gin.Context) {
+	c.String(http.StatusForbidden, "Access denied")
+	apiRequestsDenied.Inc()
+	c.Abort()
+}
+
+// apiAccess rejects denied addresses and keys before anything else looks at the request
+func apiAccess() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if ip := net.ParseIP(getIP(c)); ip != nil && accessRules.ipDenied(ip) {
+			denyAccess(c)
+			return
+		}
+
+		if key := c.GetHeader("api-key"); key != "" && accessRules.keyDenied(hashKey(key)) {
+			denyAccess(c)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// requireAdmin only lets requests through that carry the configured admin token
+func requireAdmin(cfg *adminConfig) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if cfg.Token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.Token)) != 1 {
+			c.String(http.StatusUnauthorized, "admin token required")
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func accessListHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		rules, err := listAccessRules(db)
+		if err != nil {
+			requestLog(c).WithError(err).Error("Error listing access rules")
+			c.String(http.StatusInternalServerError, "Couldn't list access rules")
+			return
+		}
+		c.JSON(http.StatusOK, rules)
+	}
+}
+
+func accessSaveHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var rule accessRule
+		if err := c.ShouldBindJSON(&rule); err != nil {
+			c.String(http.StatusBadRequest, "Invalid access rule")
+			return
+		}
+
+		if err := saveAccessRule(db, &rule); err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := accessRules.reload(db); err != nil {
+			requestLog(c).WithError(err).Error("Error reloading access rules")
+		}
+
+		requestLog(c).WithFields(logrus.Fields{"kind": rule.Kind, "value": rule.Value, "action": rule.Action}).Info("Access rule saved")
+		c.JSON(http.StatusOK, rule)
+	}
+}
+
+func accessDeleteHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+		if err != nil {
+			c.String(http.StatusBadRequest, "Invalid rule id")
+			return
+		}
+
+		if err = deleteAccessRule(db, id); err != nil {
+			c.String(http.StatusNotFound, err.Error())
+			return
+		}
+		if err := accessRules.reload(db); err != nil {
+			requestLog(c).WithError(err).Error("Error reloading access rules")
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestValidateAccessRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    accessRule
+		wantErr bool
+	}{
+		{"ip", accessRule{Kind: "ip", Value: "203.0.113.7", Action: accessDeny}, false},
+		{"range", accessRule{Kind: "ip", Value: " 203.0.113.0/24 ", Action: accessDeny}, false},
+		{"ipv6 range", accessRule{Kind: "ip", Value: "2001:db8::/32", Action: accessAllow}, false},
+		{"key", accessRule{Kind: "key", Value: "12", Action: accessDeny}, false},
+		{"user", accessRule{Kind: "user", Value: "1234", Action: accessAllow}, false},
+		{"bad ip", accessRule{Kind: "ip", Value: "example.com", Action: accessDeny}, true},
+		{"bad key id", accessRule{Kind: "key", Value: "abc", Action: accessDeny}, true},
+		{"bad user id", accessRule{Kind: "user", Value: "", Action: accessDeny}, true},
+		{"unknown kind", accessRule{Kind: "country", Value: "NZ", Action: accessDeny}, true},
+		{"unknown action", accessRule{Kind: "ip", Value: "203.0.113.7", Action: "block"}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateAccessRule(&tt.rule)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func mustParseNetwork(t *testing.T, entry string) *net.IPNet {
+	network, err := parseNetwork(entry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return network
+}
+
+func testAccessList(t *testing.T) *accessList {
+	al := &accessList{allow: newAccessSet(), deny: newAccessSet()}
+	al.deny.networks = []*net.IPNet{mustParseNetwork(t, "203.0.113.0/24"), mustParseNetwork(t, "2001:db8::/32")}
+	al.allow.networks = []*net.IPNet{mustParseNetwork(t, "203.0.113.7")}
+	al.deny.keys[hashKey("denied key")] = true
+	al.deny.keys[hashKey("allowed key")] = true
+	al.allow.keys[hashKey("allowed key")] = true
+	al.deny.users[1] = true
+	al.deny.users[2] = true
+	al.allow.users[2] = true
+	return al
+}
+
+func TestAccessListMatching(t *testing.T) {
+	al := testAccessList(t)
+
+	ipTests := []struct {
+		ip     string
+		denied bool
+	}{
+		{"203.0.113.1", true},
+		{"203.0.113.7", false}, // allowed within a denied range
+		{"203.0.114.1", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	}
+	for _, tt := range ipTests {
+		if got := al.ipDenied(net.ParseIP(tt.ip)); got != tt.denied {
+			t.Errorf("ip %v: got denied %v, want %v", tt.ip, got, tt.denied)
+		}
+	}
+
+	keyTests := []struct {
+		key    string
+		denied bool
+	}{
+		{"denied key", true},
+		{"allowed key", false},
+		{"other key", false},
+	}
+	for _, tt := range keyTests {
+		if got := al.keyDenied(hashKey(tt.key)); got != tt.denied {
+			t.Errorf("key %q: got denied %v, want %v", tt.key, got, tt.denied)
+		}
+	}
+
+	userTests := []struct {
+		user   int64
+		denied bool
+	}{
+		{1, true},
+		{2, false},
+		{3, false},
+	}
+	for _, tt := range userTests {
+		if got := al.userDenied(tt.user); got != tt.denied {
+			t.Errorf("user %v: got denied %v, want %v", tt.user, got, tt.denied)
+		}
+	}
+}
+
+func TestAPIAccess(t *testing.T) {
+	previous := accessRules
+	accessRules = testAccessList(t)
+	defer func() { accessRules = previous }()
+
+	router := gin.New()
+	router.GET("/", apiAccess(), func(c *gin.Context) {
+		c.String(http.StatusOK, "ok")
+	})
+
+	tests := []struct {
+		name   string
+		remote string
+		key    string
+		status int
+	}{
+		{"allowed", "198.51.100.1:1000", "", http.StatusOK},
+		{"denied address", "203.0.113.1:1000", "", http.StatusForbidden},
+		{"allowed address in denied range", "203.0.113.7:1000", "", http.StatusOK},
+		{"denied key", "198.51.100.1:1000", "denied key", http.StatusForbidden},
+		{"allowed key", "198.51.100.1:1000", "allowed key", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remote
+			if tt.key != "" {
+				req.Header.Set("api-key", tt.key)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("got status %v, want %v", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestRequireAdmin(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		header string
+		status int
+	}{
+		{"disabled without a token", "", "Bearer ", http.StatusUnauthorized},
+		{"missing header", "secret", "", http.StatusUnauthorized},
+		{"wrong token", "secret", "Bearer wrong", http.StatusUnauthorized},
+		{"right token", "secret", "Bearer secret", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.GET("/", requireAdmin(&adminConfig{Token: tt.token}), func(c *gin.Context) {
+				c.String(http.StatusOK, "ok")
+			})
+
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("got status %v, want %v", w.Code, tt.status)
+			}
+		})
+	}
+}
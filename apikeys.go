@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultKeyLabel = "default"
+	maxKeyLabel     = 64
+	maxKeysPerUser  = 20
+)
+
+type apiKey struct {
+	ID        int64      `json:"id"`
+	Label     string     `json:"label"`
+	Prefix    string     `json:"prefix"`
+	CreatedAt time.Time  `json:"created_at"`
+	LastUsed  *time.Time `json:"last_used"`
+	Requests  int64      `json:"requests"`
+	RevokesAt *time.Time `json:"revokes_at"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	hash      string
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// expiresAt is optional, keys without it only get disabled after inactivity
+func createKey(db queryer, userID int64, label string, expiresAt *time.Time) (string, *apiKey, error) {
+	if len(label) > maxKeyLabel {
+		return "", nil, fmt.Errorf("label too long")
+	}
+	if label == "" {
+		label = defaultKeyLabel
+	}
+
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM api_keys WHERE user_id = $1 AND revoked_at IS NULL", userID).Scan(&count)
+	if err != nil {
+		return "", nil, fmt.Errorf("error checking database. %v", err)
+	}
+	if count >= maxKeysPerUser {
+		return "", nil, fmt.Errorf("too many keys, revoke one first")
+	}
+
+	key, err := uniqueKey(db)
+	if err != nil {
+		return "", nil, err
+	}
+
+	k := apiKey{Label: label, Prefix: keyPrefix(key), ExpiresAt: expiresAt, hash: hashKey(key)}
+	err = db.QueryRow("INSERT INTO api_keys (user_id,label,key_prefix,key_hash,expires_at) VALUES($1,$2,$3,$4,$5) RETURNING id, created_at",
+		userID, label, k.Prefix, k.hash, expiresAt).Scan(&k.ID, &k.CreatedAt)
+	if err != nil {
+		return "", nil, fmt.Errorf("error saving key. %v", err)
+	}
+
+	// Tokens of users without usable keys aren't refreshed anymore, so catch up now
+	_, err = db.Exec("UPDATE api_tokens SET dormant=FALSE,nextRefresh=now() WHERE id=$1 AND dormant", userID)
+	if err != nil {
+		return "", nil, fmt.Errorf("error reactivating tokens. %v", err)
+	}
+
+	return key, &k, nil
+}
+
+// expiryFromDays turns an optional number of days into an absolute expiry time
+func expiryFromDays(days string) (*time.Time, error) {
+	if days == "" || days == "0" {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(days)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid expiry")
+	}
+
+	expiry := time.Now().Add(time.Duration(n) * 24 * time.Hour)
+	return &expiry, nil
+}
+
+func listKeys(db *sql.DB, userID int64) ([]apiKey, error) {
+	rows, err := db.Query("SELECT id, label, key_prefix, key_hash, created_at, last_used, request_count, revoked_at, expires_at FROM api_keys "+
+		"WHERE user_id = $1 AND (revoked_at IS NULL OR revoked_at > now()) AND (expires_at IS NULL OR expires_at > now()) ORDER BY created_at", userID)
+	if err != nil {
+		return nil, fmt.Errorf("error querying database. %v", err)
+	}
+	defer rows.Close()
+
+	keys := []apiKey{}
+	for rows.Next() {
+		var (
+			k         apiKey
+			lastUsed  sql.NullTime
+			revokesAt sql.NullTime
+			expiresAt sql.NullTime
+		)
+		if err = rows.Scan(&k.ID, &k.Label, &k.Prefix, &k.hash, &k.CreatedAt, &lastUsed, &k.Requests, &revokesAt, &expiresAt); err != nil {
+			return nil, fmt.Errorf("couldn't scan key %v", err)
+		}
+		if lastUsed.Valid {
+			k.LastUsed = &lastUsed.Time
+		}
+		if revokesAt.Valid {
+			k.RevokesAt = &revokesAt.Time
+		}
+		if expiresAt.Valid {
+			k.ExpiresAt = &expiresAt.Time
+		}
+		keys = append(keys, k)
+	}
+
+	return keys, rows.Err()
+}
+
+// regenerateKey replaces a key with a fresh one carrying the same label, expiry and tier
+// The old key keeps working for the grace period so applications can switch over
+func regenerateKey(db *sql.DB, userID int64, keyID int64, grace time.Duration) (string, *apiKey, error) {
+	// Revoking the old key and creating its replacement happen together or not at all
+	tx, err := db.Begin()
+	if err != nil {
+		return "", nil, fmt.Errorf("error starting transaction. %v", err)
+	}
+	defer tx.Rollback()
+
+	var (
+		label     string
+		tier      string
+		expiresAt sql.NullTime
+	)
+	err = tx.QueryRow("SELECT label, tier, expires_at FROM api_keys WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL FOR UPDATE", keyID, userID).
+		Scan(&label, &tier, &expiresAt)
+	if err == sql.ErrNoRows {
+		return "", nil, fmt.Errorf("no such key")
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("error checking database. %v", err)
+	}
+
+	if err = revokeKeyAt(tx, userID, keyID, time.Now().Add(grace)); err != nil {
+		return "", nil, err
+	}
+
+	var expiry *time.Time
+	if expiresAt.Valid {
+		expiry = &expiresAt.Time
+	}
+
+	key, info, err := createKey(tx, userID, label, expiry)
+	if err != nil {
+		return "", nil, err
+	}
+	if tier != defaultTier {
+		if err = setKeyTier(tx, info.ID, tier); err != nil {
+			return "", nil, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return "", nil, fmt.Errorf("error saving key. %v", err)
+	}
+	keysRegenerated.Inc()
+
+	return key, info, nil
+}
+
+func revokeKey(db *sql.DB, userID int64, keyID int64) error {
+	return revokeKeyAt(db, userID, keyID, time.Now())
+}
+
+// revokeKeyAt schedules a key to stop working, which may also bring a pending revocation forward
+func revokeKeyAt(db queryer, userID int64, keyID int64, at time.Time) error {
+	res, err := db.Exec("UPDATE api_keys SET revoked_at = $1 WHERE id = $2 AND user_id = $3 AND (revoked_at IS NULL OR revoked_at > $1)", at, keyID, userID)
+	if err != nil {
+		return fmt.Errorf("error revoking key. %v", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error revoking key. %v", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("no such key")
+	}
+
+	return nil
+}
+
+// Usage is kept in memory and written periodically so requests don't wait on the database
+type keyUse struct {
+	lastUsed time.Time
+	requests int64
+}
+
+type keyUsage struct {
+	keys map[int64]*keyUse
+	mu   sync.Mutex
+}
+
+var usedKeys = &keyUsage{keys: make(map[int64]*keyUse)}
+
+func (u *keyUsage) touch(keyID int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	use, exists := u.keys[keyID]
+	if !exists {
+		use = &keyUse{}
+		u.keys[keyID] = use
+	}
+	use.lastUsed = time.Now()
+	use.requests++
+}
+
+func (u *keyUsage) take() map[int64]*keyUse {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	keys := u.keys
+	u.keys = make(map[int64]*keyUse)
+	return keys
+}
+
+func flushKeyUsage(db *sql.DB) {
+	for id, use := range usedKeys.take() {
+		_, err := db.Exec("UPDATE api_keys SET last_used = $1, request_count = request_count + $2 WHERE id = $3", use.lastUsed, use.requests, id)
+		if err != nil {
+			logger.WithError(err).WithField("key_id", id).Error("Error saving key usage")
+		}
+	}
+}
+
+// Usage is flushed one last time when ctx is cancelled
+func flushKeyUsageRoutine(ctx context.Context, db *sql.DB) {
+	for sleepContext(ctx, time.Minute) {
+		flushKeyUsage(db)
+		keyUsageBuckets.flush(db)
+	}
+	flushKeyUsage(db)
+	keyUsageBuckets.flush(db)
+}
+
+// Reloads can change the keys config while pruneKeysRoutine runs
+var keySettings = struct {
+	sync.Mutex
+	cfg keysConfig
+}{}
+
+func setKeysConfig(cfg keysConfig) {
+	keySettings.Lock()
+	defer keySettings.Unlock()
+	keySettings.cfg = cfg
+}
+
+func currentKeysConfig() keysConfig {
+	keySettings.Lock()
+	defer keySettings.Unlock()
+	return keySettings.cfg
+}
+
+// pruneInactiveKeys disables keys that haven't been used for the inactivity period
+// Users left without usable keys go dormant so their tokens aren't refreshed for nothing
+func pruneInactiveKeys(db *sql.DB, cfg *keysConfig) error {
+	if cfg.InactivityPeriod > 0 {
+		res, err := db.Exec("UPDATE api_keys SET revoked_at = now() WHERE revoked_at IS NULL AND COALESCE(last_used, created_at) < $1",
+			time.Now().Add(-cfg.InactivityPeriod))
+		if err != nil {
+			return fmt.Errorf("error disabling inactive keys. %v", err)
+		}
+		if n, err := res.RowsAffected(); err == nil && n > 0 {
+			logger.WithField("count", n).Info("Disabled inactive keys")
+			keysPruned.Add(float64(n))
+		}
+	}
+
+	// Keys that were never migrated out of api_tokens are still usable
+	res, err := db.Exec("UPDATE api_tokens SET dormant = TRUE WHERE NOT dormant AND api_key IS NULL AND NOT EXISTS (" +
+		"SELECT 1 FROM api_keys WHERE user_id = api_tokens.id " +
+		"AND (revoked_at IS NULL OR revoked_at > now()) AND (expires_at IS NULL OR expires_at > now()))")
+	if err != nil {
+		return fmt.Errorf("error marking dormant users. %v", err)
+	}
+	if n, err := res.RowsAffected(); err == nil && n > 0 {
+		logger.WithField("count", n).Info("Stopped refreshing tokens of users without usable keys")
+		usersDormant.Add(float64(n))
+	}
+
+	return nil
+}
+
+func pruneKeysRoutine(ctx context.Context, db *sql.DB) {
+	for {
+		cfg := currentKeysConfig()
+		interval := cfg.CleanupInterval
+		if interval <= 0 {
+			interval = time.Hour
+		}
+
+		// Make sure recent usage is taken into account
+		flushKeyUsage(db)
+		if err := pruneInactiveKeys(db, &cfg); err != nil {
+			logger.WithError(err).Error("Error pruning keys")
+		}
+		if err := pruneQuotaUsage(db); err != nil {
+			logger.WithError(err).Error("Error pruning quota usage")
+		}
+		if err := pruneUsage(db); err != nil {
+			logger.WithError(err).Error("Error pruning usage")
+		}
+		if !sleepContext(ctx, interval) {
+			return
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+	"time"
+)
+
+// testDatabase connects to the database in TEST_DATABASE_DSN, tests that need one are skipped without it
+// The tests only touch their own users, but the sweeps they run apply to the whole database
+func testDatabase(t *testing.T) *sql.DB {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN not set")
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err = setupDatabase(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// createTestUser adds a user, with a key in api_tokens like before keys got their own table if legacyKey is set
+func createTestUser(t *testing.T, db *sql.DB, id int64, legacyKey string) {
+	var key interface{}
+	if legacyKey != "" {
+		key = legacyKey
+	}
+
+	if _, err := db.Exec("DELETE FROM api_tokens WHERE id = $1", id); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.Exec("INSERT INTO api_tokens (id, api_key, expiryTime, accessToken, refreshToken) VALUES ($1, $2, now(), 'access', 'refresh')", id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec("DELETE FROM api_tokens WHERE id = $1", id) })
+}
+
+func userDormant(t *testing.T, db *sql.DB, id int64) bool {
+	var dormant bool
+	if err := db.QueryRow("SELECT dormant FROM api_tokens WHERE id = $1", id).Scan(&dormant); err != nil {
+		t.Fatal(err)
+	}
+	return dormant
+}
+
+func TestPruneInactiveKeysDormant(t *testing.T) {
+	db := testDatabase(t)
+
+	legacyKey, err := randomString(64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		legacyUser  = 900000001
+		keyUser     = 900000002
+		keylessUser = 900000003
+	)
+	createTestUser(t, db, legacyUser, legacyKey)
+	createTestUser(t, db, keyUser, "")
+	createTestUser(t, db, keylessUser, "")
+	if _, _, err = createKey(db, keyUser, "test", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = pruneInactiveKeys(db, &keysConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		id      int64
+		dormant bool
+	}{
+		{"unmigrated legacy key", legacyUser, false},
+		{"usable key", keyUser, false},
+		{"no keys", keylessUser, true},
+	}
+	for _, tt := range tests {
+		if got := userDormant(t, db, tt.id); got != tt.dormant {
+			t.Errorf("%v: got dormant %v, want %v", tt.name, got, tt.dormant)
+		}
+	}
+
+	// Migrating a legacy key wakes the user up again like creating a key does
+	if _, err = db.Exec("UPDATE api_tokens SET dormant = TRUE WHERE id = $1", legacyUser); err != nil {
+		t.Fatal(err)
+	}
+	info, err := migrateLegacyKey(legacyKey, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.userID != legacyUser {
+		t.Fatalf("got user %v, want %v", info.userID, legacyUser)
+	}
+	if userDormant(t, db, legacyUser) {
+		t.Fatalf("user is still dormant after migrating their key")
+	}
+}
+
+func TestRegenerateKeyKeepsTier(t *testing.T) {
+	db := testDatabase(t)
+
+	const (
+		user = 900000004
+		tier = "test-elevated"
+	)
+	if err := saveTier(db, rateTier{Name: tier, Rate: 10, Burst: 10}); err != nil {
+		t.Fatal(err)
+	}
+	// Registered first so it runs after the user and their keys are gone
+	t.Cleanup(func() { db.Exec("DELETE FROM rate_tiers WHERE name = $1", tier) })
+	createTestUser(t, db, user, "")
+
+	_, old, err := createKey(db, user, "bot", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = setKeyTier(db, old.ID, tier); err != nil {
+		t.Fatal(err)
+	}
+
+	_, replacement, err := regenerateKey(db, user, old.ID, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replacement.Label != "bot" {
+		t.Errorf("got label %q, want bot", replacement.Label)
+	}
+
+	var got string
+	if err = db.QueryRow("SELECT tier FROM api_keys WHERE id = $1", replacement.ID).Scan(&got); err != nil {
+		t.Fatal(err)
+	}
+	if got != tier {
+		t.Errorf("got tier %q, want %q", got, tier)
+	}
+
+	var gracePeriod bool
+	err = db.QueryRow("SELECT revoked_at > now() + interval '30 minutes' FROM api_keys WHERE id = $1", old.ID).Scan(&gracePeriod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gracePeriod {
+		t.Errorf("the old key should keep working for the grace period")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
 
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
@@ -36,6 +37,28 @@ func paramsToString(params gin.Params) string {
 	return strings.Join(vals, "/")
 }
 
+func cacheKey(handler rmtHandler, params gin.Params) string {
+	return handler.name + "-" + paramsToString(params)
+}
+
+// purgeUserCache removes cached responses of endpoints that are specific to one of the given users
+func purgeUserCache(cache *clientv3.Client, users ...string) error {
+	for _, handler := range rmtHandlers {
+		if !handler.userSpecific {
+			continue
+		}
+
+		for _, user := range users {
+			_, err := cache.Delete(context.Background(), handler.name+"-"+user+"/", clientv3.WithPrefix())
+			if err != nil {
+				return fmt.Errorf("error purging %v cache of %v. %v", handler.name, user, err)
+			}
+		}
+	}
+
+	return nil
+}
+
 func apiCacheNoCache() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Next()
@@ -44,31 +67,37 @@ func apiCacheNoCache() gin.HandlerFunc {
 
 func apiCache(cache *clientv3.Client, handler rmtHandler) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		key := handler.name + "-" + paramsToString(c.Params)
+		key := cacheKey(handler, c.Params)
 
-		resp, err := cache.Get(context.Background(), key)
+		ctx, span := startSpan(c, "cache get")
+		span.SetAttributes(attribute.String("cache.key", key))
+		resp, err := cache.Get(ctx, key)
+		span.SetAttributes(attribute.Bool("cache.hit", err == nil && len(resp.Kvs) != 0))
+		endSpanWithError(span, err)
 		if err == nil && len(resp.Kvs) != 0 {
-			fmt.Println("Loaded from cache", key)
+			requestLog(c).WithField("cache_key", key).Debug("Loaded from cache")
 			apiCallCached.Inc()
 			apiCallSuccess.Inc()
+			c.Set("cache", "hit")
 			c.Header("Cache-Control", "public, max-age=604800")
 			c.String(http.StatusOK, string(resp.Kvs[0].Value))
 			c.Abort()
 			return
 		}
 
+		c.Set("cache", "miss")
 		c.Next()
 
 		valueInterface, exists := c.Get("value")
 		if !exists {
-			fmt.Println("No value to cache :(")
+			requestLog(c).Debug("No value to cache")
 			c.Header("Cache-Control", "max-age=0")
 			return
 		}
 
 		value, ok := valueInterface.(string)
 		if !ok {
-			fmt.Println("No value (of correct type) to cache :(")
+			requestLog(c).Warn("No value (of correct type) to cache")
 			c.Header("Cache-Control", "max-age=0")
 			return
 		}
@@ -76,13 +105,16 @@ func apiCache(cache *clientv3.Client, handler rmtHandler) gin.HandlerFunc {
 		// Note that redis is single-threaded, so this isn't a race condition probably
 		// It isn't an issue if we overwrite data as it should be identical
 		// The only issue is potentially duplicate work
-		fmt.Println("Caching", key)
-		_, err = cache.Put(context.Background(), key, value)
+		requestLog(c).WithField("cache_key", key).Debug("Caching")
+		ctx, span = startSpan(c, "cache put")
+		span.SetAttributes(attribute.String("cache.key", key))
+		_, err = cache.Put(ctx, key, value)
+		endSpanWithError(span, err)
 		if err != nil {
-			fmt.Println("Failed to cache", key, err)
+			requestLog(c).WithError(err).WithField("cache_key", key).Error("Failed to cache")
 			c.Header("Cache-Control", "max-age=0")
 		} else {
-			fmt.Println("Cached", key)
+			requestLog(c).WithField("cache_key", key).Debug("Cached")
 			c.Header("Cache-Control", "public, max-age=604800")
 		}
 	}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Forwarding headers are only believed when they were set by one of these
+var trustedProxies []*net.IPNet
+
+func setupTrustedProxies(cfg *reverseProxyConfig) error {
+	trustedProxies = nil
+	for _, entry := range cfg.Trusted {
+		network, err := parseNetwork(entry)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %v. %v", entry, err)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+	return nil
+}
+
+// parseNetwork accepts CIDR ranges as well as single addresses
+func parseNetwork(entry string) (*net.IPNet, error) {
+	if strings.Contains(entry, "/") {
+		_, network, err := net.ParseCIDR(entry)
+		return network, err
+	}
+
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("not an ip address")
+	}
+	bits := 128
+	if ip.To4() != nil {
+		ip = ip.To4()
+		bits = 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHostIP strips ports, brackets and quotes from an address in a forwarding header
+func parseHostIP(addr string) net.IP {
+	addr = strings.Trim(strings.TrimSpace(addr), "\"")
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
+
+// forwardedChain lists the addresses a request passed through, closest to the client first
+func forwardedChain(c *gin.Context) []string {
+	if forwarded := c.Request.Header.Values("Forwarded"); len(forwarded) > 0 {
+		var chain []string
+		for _, element := range strings.Split(strings.Join(forwarded, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					chain = append(chain, kv[1])
+				}
+			}
+		}
+		return chain
+	}
+
+	if forwarded := c.Request.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		return strings.Split(strings.Join(forwarded, ","), ",")
+	}
+
+	if realIP := c.GetHeader("X-Real-IP"); realIP != "" {
+		return []string{realIP}
+	}
+
+	return nil
+}
+
+// getIP returns the client address, only following forwarding headers through trusted proxies
+func getIP(c *gin.Context) string {
+	remote := parseHostIP(c.Request.RemoteAddr)
+	if remote == nil {
+		return c.Request.RemoteAddr
+	}
+	if !isTrustedProxy(remote) {
+		return remote.String()
+	}
+
+	// Walk back from the closest hop, the first address we don't trust is the client
+	client := remote
+	chain := forwardedChain(c)
+	for i := len(chain) - 1; i >= 0; i-- {
+		ip := parseHostIP(chain[i])
+		if ip == nil {
+			// Obfuscated or garbled, so nothing before it can be trusted either
+			break
+		}
+		client = ip
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+
+	return client.String()
+}
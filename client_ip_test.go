@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestParseNetwork(t *testing.T) {
+	tests := []struct {
+		entry   string
+		want    string
+		wantErr bool
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8", false},
+		{"192.168.1.5", "192.168.1.5/32", false},
+		{"::1", "::1/128", false},
+		{"fd00::/8", "fd00::/8", false},
+		{"10.0.0.0/33", "", true},
+		{"proxy.local", "", true},
+		{"", "", true},
+	}
+
+	for _, tt := range tests {
+		network, err := parseNetwork(tt.entry)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%q: got error %v, want error %v", tt.entry, err, tt.wantErr)
+			continue
+		}
+		if err == nil && network.String() != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.entry, network, tt.want)
+		}
+	}
+}
+
+func TestParseHostIP(t *testing.T) {
+	tests := []struct {
+		addr string
+		want string
+	}{
+		{"203.0.113.7", "203.0.113.7"},
+		{" 203.0.113.7 ", "203.0.113.7"},
+		{"203.0.113.7:1234", "203.0.113.7"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"\"[2001:db8::1]\"", "2001:db8::1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"unknown", "<nil>"},
+		{"_hidden", "<nil>"},
+	}
+
+	for _, tt := range tests {
+		if got := parseHostIP(tt.addr).String(); got != tt.want {
+			t.Errorf("%q: got %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestGetIP(t *testing.T) {
+	if err := setupTrustedProxies(&reverseProxyConfig{Trusted: []string{"127.0.0.1", "10.0.0.0/8"}}); err != nil {
+		t.Fatal(err)
+	}
+	defer setupTrustedProxies(&reverseProxyConfig{})
+
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{"direct client", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted peer can't spoof", "203.0.113.7:5000", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "203.0.113.7"},
+		{"trusted proxy without headers", "127.0.0.1:5000", nil, "127.0.0.1"},
+		{"x-forwarded-for", "127.0.0.1:5000", map[string]string{"X-Forwarded-For": "203.0.113.7"}, "203.0.113.7"},
+		{"spoofed entry before the client", "127.0.0.1:5000", map[string]string{"X-Forwarded-For": "1.2.3.4, 203.0.113.7"}, "203.0.113.7"},
+		{"chain of trusted proxies", "127.0.0.1:5000", map[string]string{"X-Forwarded-For": "203.0.113.7, 10.1.2.3"}, "203.0.113.7"},
+		{"only trusted hops", "127.0.0.1:5000", map[string]string{"X-Forwarded-For": "10.0.0.2, 10.0.0.1"}, "10.0.0.2"},
+		{"garbage stops the walk", "127.0.0.1:5000", map[string]string{"X-Forwarded-For": "203.0.113.7, garbage, 10.0.0.1"}, "10.0.0.1"},
+		{"forwarded header", "127.0.0.1:5000", map[string]string{"Forwarded": "for=\"[2001:db8::1]:4711\";proto=https, for=10.0.0.1"}, "2001:db8::1"},
+		{"forwarded takes precedence", "127.0.0.1:5000", map[string]string{"Forwarded": "for=203.0.113.7", "X-Forwarded-For": "1.2.3.4"}, "203.0.113.7"},
+		{"x-real-ip", "127.0.0.1:5000", map[string]string{"X-Real-IP": "203.0.113.7"}, "203.0.113.7"},
+		{"unparseable remote address", "pipe", nil, "pipe"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("GET", "/", nil)
+			c.Request.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				c.Request.Header.Set(k, v)
+			}
+
+			if got := getIP(c); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
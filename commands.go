@@ -0,0 +1,264 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+)
+
+type command struct {
+	description string
+	// Standalone commands run before the config is loaded and get neither it nor the database
+	standalone bool
+	run        func(db *sql.DB, cfg config, args []string) error
+}
+
+var commands = map[string]command{
+	"encrypt-tokens": {
+		description: "Encrypt stored tokens with the active encryption key",
+		run:         encryptTokensCommand,
+	},
+	"hash-keys": {
+		description: "Replace api keys stored in clear text with their hashes",
+		run:         hashKeysCommand,
+	},
+	"tiers": {
+		description: "List rate limit tiers",
+		run:         tiersCommand,
+	},
+	"set-tier": {
+		description: "Create or update a tier: set-tier <name> <rate> <burst> [daily quota] [monthly quota]",
+		run:         setTierCommand,
+	},
+	"set-key-tier": {
+		description: "Assign a tier to a key: set-key-tier <key id> <tier>",
+		run:         setKeyTierCommand,
+	},
+	"check-config": {
+		description: "Validate a config file: check-config [path]",
+		standalone:  true,
+		run:         checkConfigCommand,
+	},
+	"delete-user": {
+		description: "Delete a user by osu! user id and revoke their token",
+		run:         deleteUserCommand,
+	},
+}
+
+func printCommands() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Println("Available commands:")
+	for _, name := range names {
+		fmt.Printf("  %-20s %s\n", name, commands[name].description)
+	}
+}
+
+func runCommand(db *sql.DB, cfg config, args []string) error {
+	cmd, exists := commands[args[0]]
+	if !exists {
+		printCommands()
+		return fmt.Errorf("unknown command %v", args[0])
+	}
+
+	return cmd.run(db, cfg, args[1:])
+}
+
+func encryptTokensCommand(db *sql.DB, cfg config, args []string) error {
+	if !tokenCrypt.enabled() {
+		return fmt.Errorf("no active encryption key configured")
+	}
+
+	rows, err := db.Query("SELECT id, accessToken, refreshToken FROM api_tokens")
+	if err != nil {
+		return fmt.Errorf("error querying database. %v", err)
+	}
+
+	type storedTokens struct {
+		id           int64
+		accessToken  string
+		refreshToken string
+	}
+
+	var pending []storedTokens
+	for rows.Next() {
+		var t storedTokens
+		if err = rows.Scan(&t.id, &t.accessToken, &t.refreshToken); err != nil {
+			rows.Close()
+			return fmt.Errorf("couldn't scan tokens %v", err)
+		}
+		if tokenCrypt.needsEncryption(t.accessToken) || tokenCrypt.needsEncryption(t.refreshToken) {
+			pending = append(pending, t)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("error reading tokens. %v", err)
+	}
+
+	fmt.Println("Encrypting tokens of", len(pending), "users...")
+	for _, t := range pending {
+		accessToken, err := tokenCrypt.decrypt(t.accessToken)
+		if err != nil {
+			return fmt.Errorf("couldn't decrypt access token of user %v. %v", t.id, err)
+		}
+		refreshToken, err := tokenCrypt.decrypt(t.refreshToken)
+		if err != nil {
+			return fmt.Errorf("couldn't decrypt refresh token of user %v. %v", t.id, err)
+		}
+
+		accessToken, refreshToken, err = encryptTokens(accessToken, refreshToken)
+		if err != nil {
+			return err
+		}
+
+		// Only overwrite if nothing refreshed the tokens in the meantime
+		_, err = db.Exec("UPDATE api_tokens SET accessToken=$1,refreshToken=$2 WHERE id=$3 AND accessToken=$4 AND refreshToken=$5",
+			accessToken, refreshToken, t.id, t.accessToken, t.refreshToken)
+		if err != nil {
+			return fmt.Errorf("couldn't save tokens of user %v. %v", t.id, err)
+		}
+	}
+
+	fmt.Println("Done")
+	return nil
+}
+
+func hashKeysCommand(db *sql.DB, cfg config, args []string) error {
+	count, err := hashLegacyKeys(db)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Hashed keys of", count, "users")
+	return nil
+}
+
+func deleteUserCommand(db *sql.DB, cfg config, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: delete-user <user id>")
+	}
+
+	id, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid user id %v", args[0])
+	}
+
+	cache := setupCache(&cfg.EtcdConfig)
+	defer cache.Close()
+
+	if err = deleteUser(db, cache, id); err != nil {
+		return err
+	}
+
+	fmt.Println("Deleted user", id)
+	return nil
+}
+
+func tiersCommand(db *sql.DB, cfg config, args []string) error {
+	tiers, err := listTiers(db)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-20s %10s %8s %12s %14s\n", "name", "rate", "burst", "daily quota", "monthly quota")
+	for _, t := range tiers {
+		fmt.Printf("%-20s %10.3f %8d %12d %14d\n", t.Name, float64(t.Rate), t.Burst, t.DailyQuota, t.MonthlyQuota)
+	}
+	return nil
+}
+
+func setTierCommand(db *sql.DB, cfg config, args []string) error {
+	if len(args) < 3 || len(args) > 5 {
+		return fmt.Errorf("usage: set-tier <name> <rate> <burst> [daily quota] [monthly quota]")
+	}
+
+	r, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		return fmt.Errorf("invalid rate %v", args[1])
+	}
+	burst, err := strconv.Atoi(args[2])
+	if err != nil {
+		return fmt.Errorf("invalid burst %v", args[2])
+	}
+
+	var daily, monthly int64
+	if len(args) >= 4 {
+		if daily, err = strconv.ParseInt(args[3], 10, 64); err != nil {
+			return fmt.Errorf("invalid daily quota %v", args[3])
+		}
+	}
+	if len(args) == 5 {
+		if monthly, err = strconv.ParseInt(args[4], 10, 64); err != nil {
+			return fmt.Errorf("invalid monthly quota %v", args[4])
+		}
+	}
+
+	err = saveTier(db, rateTier{Name: args[0], Rate: rate.Limit(r), Burst: burst, DailyQuota: daily, MonthlyQuota: monthly})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println("Saved tier", args[0])
+	return nil
+}
+
+func setKeyTierCommand(db *sql.DB, cfg config, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: set-key-tier <key id> <tier>")
+	}
+
+	keyID, err := strconv.ParseInt(args[0], 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid key id %v", args[0])
+	}
+
+	if err = setKeyTier(db, keyID, args[1]); err != nil {
+		return err
+	}
+
+	fmt.Println("Key", keyID, "now uses tier", args[1])
+	return nil
+}
+
+func checkConfigCommand(_ *sql.DB, _ config, args []string) error {
+	path := ""
+	if len(args) > 0 {
+		path = args[0]
+	}
+
+	err := readConfig(path)
+	if viper.ConfigFileUsed() != "" {
+		fmt.Println("Checking", viper.ConfigFileUsed())
+	}
+	if err != nil {
+		return err
+	}
+
+	var problems configErrors
+	cfg, err := unmarshalConfig()
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+	if err = validateConfig(&cfg); err != nil {
+		problems = append(problems, err.(configErrors)...)
+	}
+
+	if len(problems) > 0 {
+		for _, problem := range problems {
+			fmt.Println("  -", problem)
+		}
+		return fmt.Errorf("config is invalid, found %v problems", len(problems))
+	}
+
+	fmt.Println("Config is valid")
+	return nil
+}
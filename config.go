@@ -1,18 +1,49 @@
 package main
 
 import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
 )
 
 type databaseConfig struct {
 	Dsn string
 }
 
+// Limits are given either as a rate per second or as the interval between requests, which takes precedence
+type limitConfig struct {
+	Rate     float64       `mapstructure:"rate"`
+	Interval time.Duration `mapstructure:"interval"`
+	Burst    int           `mapstructure:"burst"`
+	// Only used for remote limits, requests wait up to max_wait for a free slot instead of being rejected
+	QueueSize int           `mapstructure:"queue_size"`
+	MaxWait   time.Duration `mapstructure:"max_wait"`
+}
+
 type endpointConfig struct {
-	Handler     string `mapstructure:"handler"`
-	CachePolicy string `mapstructure:"cache"`
+	Handler     string       `mapstructure:"handler"`
+	CachePolicy string       `mapstructure:"cache"`
+	LocalLimit  *limitConfig `mapstructure:"local_limit"`
+	RemoteLimit *limitConfig `mapstructure:"remote_limit"`
+	// How much a request counts towards quotas, defaults to 1 when unset, 0 makes requests free
+	Cost *int64 `mapstructure:"cost"`
+}
+
+type limitsConfig struct {
+	Backend string      `mapstructure:"backend"`
+	IP      limitConfig `mapstructure:"ip"`
+	Auth    limitConfig `mapstructure:"auth"`
+	Key     limitConfig `mapstructure:"key"`
+	Remote  limitConfig `mapstructure:"remote"`
+	// Lower the remote limit when osu! reports that we're close to or over its limit
+	AdaptRemote bool `mapstructure:"adapt_remote"`
 }
 
 type authServerConfig struct {
@@ -20,6 +51,32 @@ type authServerConfig struct {
 	EnableAuth bool   `mapstructure:"enable_auth"`
 }
 
+type reverseProxyConfig struct {
+	// Addresses or CIDR ranges whose forwarding headers are trusted
+	Trusted []string `mapstructure:"trusted"`
+}
+
+type adminConfig struct {
+	// Bearer token for the admin endpoints, empty disables them
+	Token string `mapstructure:"token"`
+}
+
+type logConfig struct {
+	// debug, info, warn or error
+	Level string `mapstructure:"level"`
+	// json or text
+	Format string `mapstructure:"format"`
+}
+
+type tracingConfig struct {
+	// none, stdout or otlp
+	Exporter string `mapstructure:"exporter"`
+	// host:port of the OTLP/HTTP collector
+	Endpoint    string  `mapstructure:"endpoint"`
+	Insecure    bool    `mapstructure:"insecure"`
+	SampleRatio float64 `mapstructure:"sample_ratio"`
+}
+
 type promServerConfig struct {
 	Address string `mapstructure:"address"`
 }
@@ -45,17 +102,47 @@ type osuAPIConfig struct {
 	RedirectURI  string `mapstructure:"redirect_uri"`
 }
 
+type keysConfig struct {
+	RegenerateGracePeriod time.Duration `mapstructure:"regenerate_grace_period"`
+	InactivityPeriod      time.Duration `mapstructure:"inactivity_period"`
+	CleanupInterval       time.Duration `mapstructure:"cleanup_interval"`
+}
+
+type encryptionConfig struct {
+	ActiveKey string   `mapstructure:"active_key"`
+	Keys      []string `mapstructure:"keys"`
+}
+
 type config struct {
-	Database   databaseConfig   `mapstructure:"database"`
-	APIConfig  osuAPIConfig     `mapstructure:"api"`
-	EtcdConfig etcdConfig       `mapstructure:"cache"`
-	APIServer  apiserverConfig  `mapstructure:"apiserver"`
-	Auth       authServerConfig `mapstructure:"auth"`
-	PromServer promServerConfig `mapstructure:"prom"`
-	App        appConfig        `mapstructure:"application"`
+	// How long requests in flight get to finish on shutdown
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
+
+	Database   databaseConfig     `mapstructure:"database"`
+	APIConfig  osuAPIConfig       `mapstructure:"api"`
+	EtcdConfig etcdConfig         `mapstructure:"cache"`
+	APIServer  apiserverConfig    `mapstructure:"apiserver"`
+	Auth       authServerConfig   `mapstructure:"auth"`
+	PromServer promServerConfig   `mapstructure:"prom"`
+	App        appConfig          `mapstructure:"application"`
+	Encryption encryptionConfig   `mapstructure:"encryption"`
+	Keys       keysConfig         `mapstructure:"keys"`
+	Limits     limitsConfig       `mapstructure:"limits"`
+	Proxy      reverseProxyConfig `mapstructure:"reverse_proxy"`
+	Admin      adminConfig        `mapstructure:"admin"`
+	Log        logConfig          `mapstructure:"log"`
+	Tracing    tracingConfig      `mapstructure:"tracing"`
 }
 
-func getConfig() (config, error) {
+// getConfig reads the config from the default locations, or from path if it isn't empty
+func getConfig(path string) (config, error) {
+	if err := readConfig(path); err != nil {
+		return config{}, err
+	}
+
+	return unmarshalConfig()
+}
+
+func readConfig(path string) error {
 	viper.AutomaticEnv()
 	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 
@@ -64,16 +151,254 @@ func getConfig() (config, error) {
 	viper.AddConfigPath("/etc/osuproxy/")
 	viper.AddConfigPath("$HOME/.osuproxy/")
 	viper.AddConfigPath(".")
+	if path != "" {
+		viper.SetConfigFile(path)
+	}
+
+	// Limits that aren't configured keep their previous hard-coded values
+	viper.SetDefault("limits.ip.rate", 2)
+	viper.SetDefault("limits.ip.burst", 3)
+	viper.SetDefault("limits.auth.rate", 1.0/30)
+	viper.SetDefault("limits.auth.burst", 1)
+	viper.SetDefault("limits.key.rate", 2)
+	viper.SetDefault("limits.key.burst", 3)
+	viper.SetDefault("limits.remote.rate", 10)
+	viper.SetDefault("limits.remote.burst", 1)
+	viper.SetDefault("limits.adapt_remote", true)
+	viper.SetDefault("shutdown_timeout", "30s")
+	// Every trace unless configured otherwise, 0 turns sampling off
+	viper.SetDefault("tracing.sample_ratio", 1.0)
 
+	return viper.ReadInConfig()
+}
+
+// unmarshalConfig rejects keys that don't belong to any setting, as they're most likely typos
+func unmarshalConfig() (config, error) {
 	var cfg config
+	if err := viper.UnmarshalExact(&cfg); err != nil {
+		// Decode what can be decoded so the other settings can still be checked
+		var lenient config
+		viper.Unmarshal(&lenient)
+		// The decoder lists its problems on separate lines
+		return lenient, fmt.Errorf("error parsing config. %v", strings.Join(strings.Fields(err.Error()), " "))
+	}
+	return cfg, nil
+}
 
-	if err := viper.ReadInConfig(); err != nil {
-		return cfg, err
+func (l limitConfig) limit() rate.Limit {
+	if l.Interval > 0 {
+		return rate.Every(l.Interval)
 	}
+	return rate.Limit(l.Rate)
+}
 
-	if err := viper.Unmarshal(&cfg); err != nil {
-		return cfg, err
+func (l limitConfig) newLimiter() *rate.Limiter {
+	return rate.NewLimiter(l.limit(), l.Burst)
+}
+
+func (l limitConfig) validate() error {
+	if l.Rate < 0 || l.Interval < 0 {
+		return fmt.Errorf("rate and interval can't be negative")
+	}
+	if l.Rate == 0 && l.Interval == 0 {
+		return fmt.Errorf("either rate or interval has to be set")
+	}
+	if l.Burst < 1 {
+		return fmt.Errorf("burst has to be at least 1")
+	}
+	if l.QueueSize < 0 {
+		return fmt.Errorf("queue_size can't be negative")
+	}
+	if l.QueueSize > 0 && l.MaxWait <= 0 {
+		return fmt.Errorf("max_wait has to be set when queueing")
 	}
+	return nil
+}
 
-	return cfg, nil
+func validateLimits(cfg *config) error {
+	if cfg.Limits.Backend != "" && cfg.Limits.Backend != "local" && cfg.Limits.Backend != "etcd" {
+		return fmt.Errorf("unknown limit backend %v", cfg.Limits.Backend)
+	}
+
+	limits := map[string]limitConfig{
+		"ip":     cfg.Limits.IP,
+		"auth":   cfg.Limits.Auth,
+		"key":    cfg.Limits.Key,
+		"remote": cfg.Limits.Remote,
+	}
+	for name, l := range limits {
+		if err := l.validate(); err != nil {
+			return fmt.Errorf("invalid limit %v: %v", name, err)
+		}
+	}
+
+	for _, endpoint := range cfg.APIServer.Endpoints {
+		if endpoint.Cost != nil && *endpoint.Cost < 0 {
+			return fmt.Errorf("cost of endpoint %v can't be negative", endpoint.Handler)
+		}
+		if endpoint.LocalLimit != nil {
+			if err := endpoint.LocalLimit.validate(); err != nil {
+				return fmt.Errorf("invalid local limit of endpoint %v: %v", endpoint.Handler, err)
+			}
+		}
+		if endpoint.RemoteLimit != nil {
+			if err := endpoint.RemoteLimit.validate(); err != nil {
+				return fmt.Errorf("invalid remote limit of endpoint %v: %v", endpoint.Handler, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// configErrors lists every problem found so they can be fixed in one go
+type configErrors []string
+
+func (e configErrors) Error() string {
+	return strings.Join(e, "; ")
+}
+
+func validAddress(address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %v", port)
+	}
+	return nil
+}
+
+func validURL(value string) error {
+	u, err := url.Parse(value)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("has to be an absolute http or https url")
+	}
+	return nil
+}
+
+// validateConfig checks all sections, so that mistakes show up at startup instead of as confusing failures later
+func validateConfig(cfg *config) error {
+	var problems configErrors
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if cfg.Database.Dsn == "" {
+		add("database.dsn is required")
+	}
+	if len(cfg.EtcdConfig.Endpoints) == 0 {
+		add("cache.endpoints needs at least one endpoint")
+	}
+
+	if cfg.APIConfig.ClientID <= 0 {
+		add("api.client_id is required")
+	}
+	if cfg.APIConfig.ClientSecret == "" {
+		add("api.client_secret is required, set it in the file or with API_CLIENT_SECRET")
+	}
+	if err := validURL(cfg.APIConfig.RedirectURI); err != nil {
+		add("api.redirect_uri %v", err)
+	}
+	if cfg.App.AppKeyURL != "" {
+		if _, err := url.Parse(cfg.App.AppKeyURL); err != nil {
+			add("application.api_key_update_url is invalid: %v", err)
+		}
+	}
+
+	addresses := []struct{ name, address string }{
+		{"auth.address", cfg.Auth.Address},
+		{"apiserver.address", cfg.APIServer.Address},
+		{"prom.address", cfg.PromServer.Address},
+	}
+	used := make(map[string]string)
+	for _, a := range addresses {
+		name, address := a.name, a.address
+		if err := validAddress(address); err != nil {
+			add("%v %q is invalid: %v", name, address, err)
+			continue
+		}
+		if other, exists := used[address]; exists {
+			add("%v and %v both use %v", name, other, address)
+		}
+		used[address] = name
+	}
+
+	for _, origin := range cfg.APIServer.AllowedOrigins {
+		if origin == "*" {
+			continue
+		}
+		if err := validURL(origin); err != nil {
+			add("apiserver.allowed_origins %q %v", origin, err)
+		} else if u, _ := url.Parse(origin); u.Path != "" && u.Path != "/" {
+			add("apiserver.allowed_origins %q can't have a path", origin)
+		}
+	}
+
+	handlers := handlersMap()
+	seen := make(map[string]bool)
+	for i, endpoint := range cfg.APIServer.Endpoints {
+		if _, exists := handlers[endpoint.Handler]; !exists {
+			add("apiserver.endpoint[%v].handler %q is unknown", i, endpoint.Handler)
+		}
+		if seen[endpoint.Handler] {
+			add("apiserver.endpoint[%v].handler %q is configured more than once", i, endpoint.Handler)
+		}
+		seen[endpoint.Handler] = true
+
+		if endpoint.CachePolicy != "" && endpoint.CachePolicy != "always" && endpoint.CachePolicy != "never" {
+			add("apiserver.endpoint[%v].cache %q has to be always or never", i, endpoint.CachePolicy)
+		}
+	}
+
+	if err := validateLimits(cfg); err != nil {
+		add("limits: %v", err)
+	}
+
+	if cfg.Keys.RegenerateGracePeriod < 0 || cfg.Keys.InactivityPeriod < 0 || cfg.Keys.CleanupInterval < 0 {
+		add("keys durations can't be negative")
+	}
+	if _, err := newTokenCrypter(&cfg.Encryption); err != nil {
+		add("encryption: %v", err)
+	}
+
+	for _, entry := range cfg.Proxy.Trusted {
+		if _, err := parseNetwork(entry); err != nil {
+			add("reverse_proxy.trusted %q is invalid: %v", entry, err)
+		}
+	}
+
+	if cfg.Log.Level != "" {
+		if _, err := logrus.ParseLevel(cfg.Log.Level); err != nil {
+			add("log.level %q has to be debug, info, warn or error", cfg.Log.Level)
+		}
+	}
+	if cfg.Log.Format != "" && cfg.Log.Format != "json" && cfg.Log.Format != "text" {
+		add("log.format %q has to be json or text", cfg.Log.Format)
+	}
+
+	switch cfg.Tracing.Exporter {
+	case "", "none", "stdout":
+	case "otlp":
+		if cfg.Tracing.Endpoint == "" {
+			add("tracing.endpoint is required for the otlp exporter")
+		}
+	default:
+		add("tracing.exporter %q has to be none, stdout or otlp", cfg.Tracing.Exporter)
+	}
+	if cfg.Tracing.SampleRatio < 0 || cfg.Tracing.SampleRatio > 1 {
+		add("tracing.sample_ratio has to be between 0 and 1")
+	}
+
+	if cfg.ShutdownTimeout <= 0 {
+		add("shutdown_timeout has to be positive")
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
 }
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		valid   bool
+	}{
+		{":8080", true},
+		{"localhost:8080", true},
+		{"0.0.0.0:0", true},
+		{"[::1]:443", true},
+		{"8080", false},
+		{"localhost", false},
+		{":http", false},
+		{":65536", false},
+		{":-1", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if err := validAddress(tt.address); (err == nil) != tt.valid {
+			t.Errorf("%q: got error %v, want valid %v", tt.address, err, tt.valid)
+		}
+	}
+}
+
+func TestValidURL(t *testing.T) {
+	tests := []struct {
+		value string
+		valid bool
+	}{
+		{"https://example.com", true},
+		{"http://localhost:8080/authorize", true},
+		{"example.com", false},
+		{"/authorize", false},
+		{"ftp://example.com", false},
+		{"https://", false},
+		{"://", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if err := validURL(tt.value); (err == nil) != tt.valid {
+			t.Errorf("%q: got error %v, want valid %v", tt.value, err, tt.valid)
+		}
+	}
+}
+
+func validTestConfig() config {
+	limit := limitConfig{Rate: 1, Burst: 1}
+	return config{
+		ShutdownTimeout: 30 * time.Second,
+		Database:        databaseConfig{Dsn: "postgres://localhost/osuproxy"},
+		APIConfig:       osuAPIConfig{ClientID: 1, ClientSecret: "secret", RedirectURI: "https://example.com/authorize"},
+		EtcdConfig:      etcdConfig{Endpoints: []string{"localhost:2379"}},
+		APIServer: apiserverConfig{
+			Address:        ":8080",
+			AllowedOrigins: []string{"https://example.com"},
+			Endpoints:      []endpointConfig{{Handler: "userinfo"}, {Handler: "scorefile", CachePolicy: "always"}},
+		},
+		Auth:       authServerConfig{Address: ":8081"},
+		PromServer: promServerConfig{Address: ":9090"},
+		Limits:     limitsConfig{IP: limit, Auth: limit, Key: limit, Remote: limit},
+		Tracing:    tracingConfig{SampleRatio: 1},
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *config)
+		want   []string // parts of the expected problems, none means valid
+	}{
+		{"valid", func(cfg *config) {}, nil},
+		{"wildcard origin", func(cfg *config) { cfg.APIServer.AllowedOrigins = []string{"*"} }, nil},
+		{"zero sample ratio", func(cfg *config) { cfg.Tracing.SampleRatio = 0 }, nil},
+		{"missing dsn", func(cfg *config) { cfg.Database.Dsn = "" }, []string{"database.dsn"}},
+		{"missing secret", func(cfg *config) { cfg.APIConfig.ClientSecret = "" }, []string{"API_CLIENT_SECRET"}},
+		{"relative redirect", func(cfg *config) { cfg.APIConfig.RedirectURI = "/authorize" }, []string{"api.redirect_uri"}},
+		{"bad address", func(cfg *config) { cfg.Auth.Address = "8081" }, []string{"auth.address"}},
+		{"shared address", func(cfg *config) { cfg.PromServer.Address = ":8080" }, []string{"prom.address and apiserver.address both use :8080"}},
+		{"origin with path", func(cfg *config) { cfg.APIServer.AllowedOrigins = []string{"https://example.com/app"} }, []string{"can't have a path"}},
+		{"unknown handler", func(cfg *config) { cfg.APIServer.Endpoints[0].Handler = "nope" }, []string{`"nope" is unknown`}},
+		{"duplicate handler", func(cfg *config) { cfg.APIServer.Endpoints[1].Handler = "userinfo" }, []string{"more than once"}},
+		{"bad cache policy", func(cfg *config) { cfg.APIServer.Endpoints[1].CachePolicy = "sometimes" }, []string{"has to be always or never"}},
+		{"bad limit", func(cfg *config) { cfg.Limits.Key.Burst = 0 }, []string{"invalid limit key"}},
+		{"free endpoint", func(cfg *config) { cfg.APIServer.Endpoints[0].Cost = new(int64) }, nil},
+		{"negative cost", func(cfg *config) {
+			cost := int64(-1)
+			cfg.APIServer.Endpoints[0].Cost = &cost
+		}, []string{"can't be negative"}},
+		{"queue without wait", func(cfg *config) { cfg.Limits.Remote.QueueSize = 5 }, []string{"max_wait"}},
+		{"negative key duration", func(cfg *config) { cfg.Keys.InactivityPeriod = -time.Hour }, []string{"keys durations"}},
+		{"encryption without active key", func(cfg *config) {
+			cfg.Encryption.Keys = []string{testEncryptionKey("1", 1)}
+		}, []string{"without an active key"}},
+		{"bad trusted proxy", func(cfg *config) { cfg.Proxy.Trusted = []string{"proxy"} }, []string{"reverse_proxy.trusted"}},
+		{"bad log level", func(cfg *config) { cfg.Log.Level = "loud" }, []string{"log.level"}},
+		{"bad log format", func(cfg *config) { cfg.Log.Format = "xml" }, []string{"log.format"}},
+		{"otlp without endpoint", func(cfg *config) { cfg.Tracing.Exporter = "otlp" }, []string{"tracing.endpoint"}},
+		{"bad sample ratio", func(cfg *config) { cfg.Tracing.SampleRatio = 2 }, []string{"sample_ratio"}},
+		{"no shutdown timeout", func(cfg *config) { cfg.ShutdownTimeout = 0 }, []string{"shutdown_timeout"}},
+		{"all problems at once", func(cfg *config) {
+			cfg.Database.Dsn = ""
+			cfg.EtcdConfig.Endpoints = nil
+			cfg.Log.Format = "xml"
+		}, []string{"database.dsn", "cache.endpoints", "log.format"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := validTestConfig()
+			tt.change(&cfg)
+
+			err := validateConfig(&cfg)
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error %v", err)
+				}
+				return
+			}
+
+			problems, ok := err.(configErrors)
+			if !ok {
+				t.Fatalf("got %v, want config errors", err)
+			}
+			if len(problems) != len(tt.want) {
+				t.Fatalf("got problems %q, want %v", problems, len(tt.want))
+			}
+			for i, want := range tt.want {
+				if !strings.Contains(problems[i], want) {
+					t.Errorf("got problem %q, want it to mention %q", problems[i], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// Encrypted values look like enc:<key id>:<wrapped data key>:<sealed value>
+// Every value gets its own data key, which is sealed with the configured key encryption key
+const encryptedPrefix = "enc:"
+
+type tokenCrypter struct {
+	activeKey string
+	keys      map[string]cipher.AEAD
+}
+
+var tokenCrypt = &tokenCrypter{}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func setupEncryption(cfg *encryptionConfig) error {
+	crypt, err := newTokenCrypter(cfg)
+	if err != nil {
+		return err
+	}
+
+	tokenCrypt = crypt
+	return nil
+}
+
+func newTokenCrypter(cfg *encryptionConfig) (*tokenCrypter, error) {
+	crypt := &tokenCrypter{
+		activeKey: cfg.ActiveKey,
+		keys:      make(map[string]cipher.AEAD),
+	}
+
+	for _, entry := range cfg.Keys {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("encryption key should have the form <id>:<base64 key>")
+		}
+
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("couldn't decode encryption key %v. %v", parts[0], err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("encryption key %v has to be 32 bytes, got %v", parts[0], len(key))
+		}
+
+		aead, err := newGCM(key)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't set up encryption key %v. %v", parts[0], err)
+		}
+		crypt.keys[parts[0]] = aead
+	}
+
+	if crypt.activeKey == "" && len(crypt.keys) > 0 {
+		return nil, fmt.Errorf("encryption keys configured without an active key")
+	}
+	if _, exists := crypt.keys[crypt.activeKey]; crypt.activeKey != "" && !exists {
+		return nil, fmt.Errorf("active encryption key %v is not configured", crypt.activeKey)
+	}
+
+	return crypt, nil
+}
+
+func (t *tokenCrypter) enabled() bool {
+	return t.activeKey != ""
+}
+
+func sealValue(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func openValue(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("sealed value too short")
+	}
+
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+// encrypt returns the value unchanged if encryption isn't configured
+func (t *tokenCrypter) encrypt(value string) (string, error) {
+	if !t.enabled() {
+		return value, nil
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", fmt.Errorf("couldn't generate data key. %v", err)
+	}
+
+	wrappedKey, err := sealValue(t.keys[t.activeKey], dataKey)
+	if err != nil {
+		return "", fmt.Errorf("couldn't wrap data key. %v", err)
+	}
+
+	dataAEAD, err := newGCM(dataKey)
+	if err != nil {
+		return "", fmt.Errorf("couldn't set up data key. %v", err)
+	}
+
+	sealed, err := sealValue(dataAEAD, []byte(value))
+	if err != nil {
+		return "", fmt.Errorf("couldn't encrypt value. %v", err)
+	}
+
+	return encryptedPrefix + t.activeKey + ":" +
+		base64.RawStdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// decrypt passes through values that were stored before encryption was enabled
+func (t *tokenCrypter) decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+
+	kek, exists := t.keys[parts[0]]
+	if !exists {
+		return "", fmt.Errorf("unknown encryption key %v", parts[0])
+	}
+
+	wrappedKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("couldn't decode data key. %v", err)
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("couldn't decode value. %v", err)
+	}
+
+	dataKey, err := openValue(kek, wrappedKey)
+	if err != nil {
+		return "", fmt.Errorf("couldn't unwrap data key. %v", err)
+	}
+
+	dataAEAD, err := newGCM(dataKey)
+	if err != nil {
+		return "", fmt.Errorf("couldn't set up data key. %v", err)
+	}
+
+	plaintext, err := openValue(dataAEAD, sealed)
+	if err != nil {
+		return "", fmt.Errorf("couldn't decrypt value. %v", err)
+	}
+
+	return string(plaintext), nil
+}
+
+// needsEncryption reports whether a stored value isn't encrypted with the active key yet
+func (t *tokenCrypter) needsEncryption(value string) bool {
+	if !t.enabled() {
+		return false
+	}
+
+	return !strings.HasPrefix(value, encryptedPrefix+t.activeKey+":")
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func testEncryptionKey(id string, fill byte) string {
+	return id + ":" + base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{fill}, 32))
+}
+
+func TestNewTokenCrypter(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     encryptionConfig
+		wantErr string
+	}{
+		{"disabled", encryptionConfig{}, ""},
+		{"active key", encryptionConfig{ActiveKey: "1", Keys: []string{testEncryptionKey("1", 1)}}, ""},
+		{"missing id", encryptionConfig{ActiveKey: "1", Keys: []string{base64.StdEncoding.EncodeToString(make([]byte, 32))}}, "should have the form"},
+		{"bad base64", encryptionConfig{ActiveKey: "1", Keys: []string{"1:not base64!"}}, "couldn't decode"},
+		{"short key", encryptionConfig{ActiveKey: "1", Keys: []string{"1:" + base64.StdEncoding.EncodeToString(make([]byte, 16))}}, "has to be 32 bytes"},
+		{"no active key", encryptionConfig{Keys: []string{testEncryptionKey("1", 1)}}, "without an active key"},
+		{"unknown active key", encryptionConfig{ActiveKey: "2", Keys: []string{testEncryptionKey("1", 1)}}, "is not configured"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newTokenCrypter(&tt.cfg)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTokenCrypterRoundTrip(t *testing.T) {
+	crypt, err := newTokenCrypter(&encryptionConfig{ActiveKey: "1", Keys: []string{testEncryptionKey("1", 1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, value := range []string{"", "token", strings.Repeat("long token ", 100)} {
+		encrypted, err := crypt.encrypt(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(encrypted, encryptedPrefix+"1:") {
+			t.Fatalf("encrypted value %q doesn't name its key", encrypted)
+		}
+		if value != "" && strings.Contains(encrypted, value) {
+			t.Fatalf("encrypted value contains the plaintext")
+		}
+		if crypt.needsEncryption(encrypted) {
+			t.Fatalf("freshly encrypted value needs encryption")
+		}
+
+		decrypted, err := crypt.decrypt(encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decrypted != value {
+			t.Fatalf("got %q, want %q", decrypted, value)
+		}
+	}
+}
+
+func TestTokenCrypterRotation(t *testing.T) {
+	old, err := newTokenCrypter(&encryptionConfig{ActiveKey: "1", Keys: []string{testEncryptionKey("1", 1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := newTokenCrypter(&encryptionConfig{ActiveKey: "2", Keys: []string{testEncryptionKey("1", 1), testEncryptionKey("2", 2)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := old.encrypt("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rotated.needsEncryption(encrypted) {
+		t.Fatalf("value encrypted with the old key should be re-encrypted")
+	}
+	if decrypted, err := rotated.decrypt(encrypted); err != nil || decrypted != "token" {
+		t.Fatalf("old value after rotation: got %q, %v", decrypted, err)
+	}
+
+	reencrypted, err := rotated.encrypt("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.needsEncryption(reencrypted) {
+		t.Fatalf("value encrypted with the active key shouldn't need encryption")
+	}
+	if _, err := old.decrypt(reencrypted); err == nil {
+		t.Fatalf("a crypter without the new key shouldn't decrypt it")
+	}
+}
+
+func TestTokenCrypterDecrypt(t *testing.T) {
+	crypt, err := newTokenCrypter(&encryptionConfig{ActiveKey: "1", Keys: []string{testEncryptionKey("1", 1)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid, err := crypt.encrypt("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(valid, ":")
+	tampered := "A" + parts[3][1:]
+	if parts[3][0] == 'A' {
+		tampered = "B" + parts[3][1:]
+	}
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"plaintext passes through", "token", "token", false},
+		{"valid", valid, "token", false},
+		{"malformed", encryptedPrefix + "1:abc", "", true},
+		{"unknown key", strings.Join([]string{parts[0], "9", parts[2], parts[3]}, ":"), "", true},
+		{"bad encoding", strings.Join([]string{parts[0], parts[1], "!!", parts[3]}, ":"), "", true},
+		{"tampered", strings.Join([]string{parts[0], parts[1], parts[2], tampered}, ":"), "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := crypt.decrypt(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTokenCrypterDisabled(t *testing.T) {
+	crypt, err := newTokenCrypter(&encryptionConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	encrypted, err := crypt.encrypt("token")
+	if err != nil || encrypted != "token" {
+		t.Fatalf("got %q, %v, want the value unchanged", encrypted, err)
+	}
+	if crypt.needsEncryption("token") {
+		t.Fatalf("nothing needs encryption without an active key")
+	}
+}
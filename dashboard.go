@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+type dashboardKey struct {
+	apiKey
+	Tier      rateTier
+	RateLimit limitStatus
+}
+
+func renderDashboard(c *gin.Context, db *sql.DB, cfg *config, extra gin.H) {
+	s := c.MustGet("session").(*session)
+
+	keys, err := listKeys(db, s.userID)
+	if err != nil {
+		requestLog(c).WithError(err).Error("Error listing keys")
+		c.HTML(http.StatusOK, "error.tmpl", gin.H{
+			"Error": "Couldn't load your keys",
+		})
+		return
+	}
+
+	dashboardKeys := make([]dashboardKey, len(keys))
+	for i, k := range keys {
+		tier := keyTiers.get(db, k.hash)
+		dashboardKeys[i] = dashboardKey{
+			apiKey:    k,
+			Tier:      tier,
+			RateLimit: visitorStatus(apiVisitors, k.hash, tier.Rate, tier.Burst),
+		}
+	}
+
+	data := gin.H{
+		"UserID":    s.userID,
+		"Keys":      dashboardKeys,
+		"CSRFToken": s.csrfToken,
+		"AppKeyURL": cfg.App.AppKeyURL,
+	}
+	for k, v := range extra {
+		data[k] = v
+	}
+
+	c.HTML(http.StatusOK, "dashboard.tmpl", data)
+}
+
+func dashboardFunc(db *sql.DB, cfg *config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		renderDashboard(c, db, cfg, nil)
+	}
+}
+
+func dashboardError(c *gin.Context, db *sql.DB, cfg *config, err error) {
+	renderDashboard(c, db, cfg, gin.H{
+		"Error": err.Error(),
+	})
+}
+
+func formKeyID(c *gin.Context) (int64, error) {
+	keyID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid key id")
+	}
+	return keyID, nil
+}
+
+func dashboardCreateKeyFunc(db *sql.DB, cfg *config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s := c.MustGet("session").(*session)
+
+		expiry, err := expiryFromDays(c.PostForm("expires_in_days"))
+		if err != nil {
+			dashboardError(c, db, cfg, err)
+			return
+		}
+
+		key, info, err := createKey(db, s.userID, c.PostForm("label"), expiry)
+		if err != nil {
+			dashboardError(c, db, cfg, err)
+			return
+		}
+
+		renderDashboard(c, db, cfg, gin.H{
+			"NewKey":      key,
+			"NewKeyLabel": info.Label,
+		})
+	}
+}
+
+func dashboardRegenerateKeyFunc(db *sql.DB, cfg *config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s := c.MustGet("session").(*session)
+
+		keyID, err := formKeyID(c)
+		if err != nil {
+			dashboardError(c, db, cfg, err)
+			return
+		}
+
+		key, info, err := regenerateKey(db, s.userID, keyID, cfg.Keys.RegenerateGracePeriod)
+		if err != nil {
+			dashboardError(c, db, cfg, err)
+			return
+		}
+
+		renderDashboard(c, db, cfg, gin.H{
+			"NewKey":      key,
+			"NewKeyLabel": info.Label,
+			"Regenerated": true,
+		})
+	}
+}
+
+func dashboardRevokeKeyFunc(db *sql.DB, cfg *config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s := c.MustGet("session").(*session)
+
+		keyID, err := formKeyID(c)
+		if err != nil {
+			dashboardError(c, db, cfg, err)
+			return
+		}
+
+		if err = revokeKey(db, s.userID, keyID); err != nil {
+			dashboardError(c, db, cfg, err)
+			return
+		}
+
+		c.Redirect(http.StatusSeeOther, "/dashboard")
+	}
+}
+
+func dashboardDeleteAccountFunc(db *sql.DB, cache *clientv3.Client, cfg *config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s := c.MustGet("session").(*session)
+
+		if c.PostForm("confirm") != "delete" {
+			dashboardError(c, db, cfg, fmt.Errorf("type \"delete\" to confirm deleting your account"))
+			return
+		}
+
+		if err := deleteUser(db, cache, s.userID); err != nil {
+			requestLog(c).WithError(err).Error("Error deleting user")
+			dashboardError(c, db, cfg, fmt.Errorf("couldn't delete your account"))
+			return
+		}
+		requestLog(c).Info("Deleted user")
+
+		setSessionCookie(c, cfg, "", -1)
+		c.Redirect(http.StatusSeeOther, "/")
+	}
+}
+
+func logoutFunc(db *sql.DB, cfg *config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := deleteSession(db, c.GetString("sessionID")); err != nil {
+			requestLog(c).WithError(err).Error("Error deleting session")
+		}
+
+		setSessionCookie(c, cfg, "", -1)
+		c.Redirect(http.StatusSeeOther, "/")
+	}
+}
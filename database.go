@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Statements are run in order on every startup, so they have to be idempotent
+var schema = []string{
+	"CREATE TABLE IF NOT EXISTS api_tokens (" +
+		"id INT PRIMARY KEY," +
+		"api_key CHAR(64) NOT NULL," +
+		"expiryTime timestamp NOT NULL," +
+		"accessToken TEXT NOT NULL," +
+		"refreshToken TEXT NOT NULL," +
+		"UNIQUE(api_key)" +
+		")",
+	"ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS nextRefresh timestamp NOT NULL DEFAULT now()",
+	"ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS refreshFailures INT NOT NULL DEFAULT 0",
+	"ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS lastRefreshError TEXT",
+	"ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS revoked BOOLEAN NOT NULL DEFAULT FALSE",
+	// Keys are only stored hashed, api_key remains for keys that weren't migrated yet
+	"ALTER TABLE api_tokens ALTER COLUMN api_key DROP NOT NULL",
+	"CREATE TABLE IF NOT EXISTS api_keys (" +
+		"id SERIAL PRIMARY KEY," +
+		"user_id INT NOT NULL REFERENCES api_tokens (id) ON DELETE CASCADE," +
+		"label TEXT NOT NULL," +
+		"key_prefix CHAR(8) NOT NULL," +
+		"key_hash CHAR(64) NOT NULL UNIQUE," +
+		"created_at timestamp NOT NULL DEFAULT now()," +
+		"last_used timestamp," +
+		"revoked_at timestamp," +
+		"expires_at timestamp," +
+		"request_count BIGINT NOT NULL DEFAULT 0" +
+		")",
+	"CREATE INDEX IF NOT EXISTS api_keys_prefix ON api_keys (key_prefix)",
+	"CREATE INDEX IF NOT EXISTS api_keys_user ON api_keys (user_id)",
+	"ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS dormant BOOLEAN NOT NULL DEFAULT FALSE",
+	"CREATE TABLE IF NOT EXISTS rate_tiers (" +
+		"name TEXT PRIMARY KEY," +
+		"rate DOUBLE PRECISION NOT NULL," +
+		"burst INT NOT NULL," +
+		"daily_quota BIGINT NOT NULL DEFAULT 0" +
+		")",
+	"INSERT INTO rate_tiers (name, rate, burst) VALUES ('default', 2, 3) ON CONFLICT DO NOTHING",
+	"ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS tier TEXT NOT NULL DEFAULT 'default' REFERENCES rate_tiers (name) ON UPDATE CASCADE",
+	"ALTER TABLE rate_tiers ADD COLUMN IF NOT EXISTS monthly_quota BIGINT NOT NULL DEFAULT 0",
+	"CREATE TABLE IF NOT EXISTS key_quotas (" +
+		"key_id INT NOT NULL REFERENCES api_keys (id) ON DELETE CASCADE," +
+		"period TEXT NOT NULL," +
+		"period_start timestamp NOT NULL," +
+		"used BIGINT NOT NULL," +
+		"PRIMARY KEY (key_id, period, period_start)" +
+		")",
+	"CREATE TABLE IF NOT EXISTS sessions (" +
+		"id_hash CHAR(64) PRIMARY KEY," +
+		"user_id INT NOT NULL REFERENCES api_tokens (id) ON DELETE CASCADE," +
+		"csrf_token TEXT NOT NULL," +
+		"expires_at timestamp NOT NULL" +
+		")",
+	"CREATE TABLE IF NOT EXISTS access_rules (" +
+		"id SERIAL PRIMARY KEY," +
+		"kind TEXT NOT NULL CHECK (kind IN ('ip', 'key', 'user'))," +
+		"value TEXT NOT NULL," +
+		"action TEXT NOT NULL CHECK (action IN ('allow', 'deny'))," +
+		"reason TEXT NOT NULL DEFAULT ''," +
+		"created_at timestamp NOT NULL DEFAULT now()," +
+		"UNIQUE (kind, value)" +
+		")",
+	"CREATE TABLE IF NOT EXISTS key_usage (" +
+		"key_id INT NOT NULL REFERENCES api_keys (id) ON DELETE CASCADE," +
+		"handler TEXT NOT NULL," +
+		"bucket_start timestamp NOT NULL," +
+		"requests BIGINT NOT NULL DEFAULT 0," +
+		"cached BIGINT NOT NULL DEFAULT 0," +
+		"upstream BIGINT NOT NULL DEFAULT 0," +
+		"PRIMARY KEY (key_id, handler, bucket_start)" +
+		")",
+	"CREATE INDEX IF NOT EXISTS key_usage_bucket ON key_usage (bucket_start)",
+}
+
+func setupDatabase(db *sql.DB) error {
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			return fmt.Errorf("error setting up database. %v", err)
+		}
+	}
+
+	return nil
+}
@@ -5,6 +5,7 @@ go 1.15
 require (
 	github.com/coreos/etcd v3.3.27+incompatible // indirect
 	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/fsnotify/fsnotify v1.5.1
 	github.com/gin-contrib/cors v1.3.1
 	github.com/gin-gonic/gin v1.7.4
 	github.com/lib/pq v1.10.3
@@ -12,7 +13,13 @@ require (
 	github.com/onsi/gomega v1.15.0 // indirect
 	github.com/prometheus/client_golang v1.12.1
 	github.com/prometheus/tsdb v0.7.1 // indirect
+	github.com/sirupsen/logrus v1.9.3
 	github.com/spf13/viper v1.9.0
-	go.etcd.io/etcd/client/v3 v3.5.2 // indirect
-	golang.org/x/time v0.0.0-20200630173020-3af7569d3a1e
+	go.etcd.io/etcd/client/v3 v3.5.2
+	go.opentelemetry.io/otel v1.10.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp v1.10.0
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.10.0
+	go.opentelemetry.io/otel/sdk v1.10.0
+	go.opentelemetry.io/otel/trace v1.10.0
+	golang.org/x/time v0.3.0
 )
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	healthCheckTimeout = 2 * time.Second
+	// osu! shouldn't be asked on every probe
+	upstreamCheckInterval = 30 * time.Second
+	upstreamHealthURL     = "https://osu.ppy.sh/oauth/token"
+)
+
+type healthCheck struct {
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+	// Failing checks that aren't critical only degrade readiness
+	Critical bool `json:"critical"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks"`
+}
+
+func runHealthCheck(critical bool, check func(ctx context.Context) error) healthCheck {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	err := check(ctx)
+	result := healthCheck{Status: "ok", LatencyMs: time.Since(start).Milliseconds(), Critical: critical}
+	if err != nil {
+		result.Status = "failing"
+		result.Error = redact(err.Error())
+	}
+	return result
+}
+
+// upstreamHealth remembers the last check of osu!'s token endpoint
+type upstreamHealth struct {
+	mu      sync.Mutex
+	last    healthCheck
+	checked time.Time
+}
+
+var osuHealth = &upstreamHealth{}
+
+func (u *upstreamHealth) check() healthCheck {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if time.Since(u.checked) < upstreamCheckInterval {
+		return u.last
+	}
+
+	u.last = runHealthCheck(false, func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", upstreamHealthURL, nil)
+		if err != nil {
+			return err
+		}
+		// Any answer means the endpoint is reachable, it doesn't accept GET anyway
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		return nil
+	})
+	u.checked = time.Now()
+
+	return u.last
+}
+
+func readiness(db *sql.DB, cache *clientv3.Client) (healthReport, bool) {
+	checks := map[string]func() healthCheck{
+		"database": func() healthCheck { return runHealthCheck(true, db.PingContext) },
+		"cache": func() healthCheck {
+			return runHealthCheck(true, func(ctx context.Context) error {
+				_, err := cache.Get(ctx, "healthcheck")
+				return err
+			})
+		},
+		"upstream": osuHealth.check,
+	}
+
+	// Checked concurrently so probes take at most one timeout
+	report := healthReport{Status: "ok", Checks: make(map[string]healthCheck)}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check func() healthCheck) {
+			defer wg.Done()
+			result := check()
+			mu.Lock()
+			report.Checks[name] = result
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	ready := true
+	for _, check := range report.Checks {
+		if check.Status == "ok" {
+			continue
+		}
+		if check.Critical {
+			ready = false
+			report.Status = "unavailable"
+		} else if ready {
+			report.Status = "degraded"
+		}
+	}
+
+	return report, ready
+}
+
+func writeHealth(w http.ResponseWriter, status int, report interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// healthzHandler only tells whether the process is able to answer at all
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// readyzHandler tells whether requests can be served, osu! being down alone doesn't take replicas out
+func readyzHandler(db *sql.DB, cache *clientv3.Client) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report, ready := readiness(db, cache)
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeHealth(w, status, report)
+	}
+}
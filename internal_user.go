@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"time"
@@ -23,7 +24,7 @@ type userCompact struct {
 }
 
 func getCurrentUser(token string) (*userCompact, error) {
-	body, err := rmtAPIRequest("https://osu.ppy.sh/api/v2/me/osu", token)
+	body, err := rmtAPIRequest(context.Background(), "https://osu.ppy.sh/api/v2/me/osu", token)
 	if err != nil {
 		return nil, fmt.Errorf("error with request. %v", err)
 	}
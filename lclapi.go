@@ -4,10 +4,11 @@ import (
 	"database/sql"
 	"fmt"
 	"net/http"
-	"sync"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
 	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
@@ -21,15 +22,25 @@ func apiAuth(db *sql.DB) gin.HandlerFunc {
 			return
 		}
 
-		token, err := keyToToken(apiKey, db)
+		_, span := startSpan(c, "auth lookup key")
+		info, err := lookupKey(apiKey, db)
+		endSpanWithError(span, err)
 		if err != nil {
 			c.String(http.StatusUnauthorized, "Couldn't get token")
 			apiRequestsBadAuth.Inc()
 			c.Abort()
 			return
 		}
+		// Keys created since the access rules were last loaded aren't known by hash yet
+		if accessRules.userDenied(info.userID) {
+			denyAccess(c)
+			return
+		}
+		usedKeys.touch(info.id)
 
-		c.Set("token", token)
+		c.Set("token", info.token)
+		c.Set("keyID", info.id)
+		c.Set("userID", info.userID)
 
 		c.Next()
 	}
@@ -51,7 +62,10 @@ func apiHandler(handler rmtHandler) gin.HandlerFunc {
 
 		url := "https://osu.ppy.sh" + handler.rmtURL(c)
 
-		val, err := rmtAPIRequest(url, token)
+		c.Set("upstream", true)
+		start := time.Now()
+		val, err := rmtAPIRequest(c.Request.Context(), url, token)
+		upstreamRequestDuration.WithLabelValues(handler.name).Observe(time.Since(start).Seconds())
 		if err == nil { // TODO: It may make sense to use this to cache in some error cases as well
 			c.Set("value", val)
 			c.String(http.StatusOK, val)
@@ -63,25 +77,86 @@ func apiHandler(handler rmtHandler) gin.HandlerFunc {
 	}
 }
 
-func apiServer(db *sql.DB, cache *clientv3.Client, cfg config, wg *sync.WaitGroup) {
-	router := gin.Default()
+// The api only manages the key it's called with, so a key leaked by one application
+// can't be used to take over the others. Everything else is done on the dashboard
+func keyInfoHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		keys, err := listKeys(db, c.GetInt64("userID"))
+		if err != nil {
+			requestLog(c).WithError(err).Error("Error listing keys")
+			c.String(http.StatusInternalServerError, "Couldn't load key")
+			return
+		}
+
+		for _, k := range keys {
+			if k.ID == c.GetInt64("keyID") {
+				c.JSON(http.StatusOK, k)
+				return
+			}
+		}
+		c.String(http.StatusNotFound, "no such key")
+	}
+}
+
+func keyRegenerateHandler(db *sql.DB, cfg *config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, info, err := regenerateKey(db, c.GetInt64("userID"), c.GetInt64("keyID"), cfg.Keys.RegenerateGracePeriod)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		res := gin.H{
+			"key":  key,
+			"info": info,
+		}
+		// Nothing is sent to the application, this is the same link the dashboard shows for a user to open
+		if cfg.App.AppKeyURL != "" {
+			res["load_url"] = cfg.App.AppKeyURL + key
+		}
+		c.JSON(http.StatusOK, res)
+	}
+}
+
+func keyRevokeHandler(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := revokeKey(db, c.GetInt64("userID"), c.GetInt64("keyID")); err != nil {
+			c.String(http.StatusNotFound, err.Error())
+			return
+		}
+
+		c.Status(http.StatusNoContent)
+	}
+}
+
+func apiRouter(db *sql.DB, cache *clientv3.Client, cfg config) (http.Handler, error) {
+	router := gin.New()
+	router.Use(gin.Recovery(), requestLogger(), apiTracing())
 
 	// authentication and local api-wide rate limits
 	router.Use(cors.New(cors.Config{
 		AllowOrigins: cfg.APIServer.AllowedOrigins,
-		AllowHeaders: []string{"api-key"},
+		AllowHeaders: []string{"api-key", "Authorization", "Content-Type", requestIDHeader, "traceparent", "tracestate"},
+		ExposeHeaders: []string{
+			"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "Retry-After", requestIDHeader,
+			"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset",
+			"X-Quota-Daily-Limit", "X-Quota-Daily-Remaining", "X-Quota-Daily-Reset",
+			"X-Quota-Monthly-Limit", "X-Quota-Monthly-Remaining", "X-Quota-Monthly-Reset",
+		},
+		AllowMethods: []string{"GET", "POST", "DELETE"},
 	}))
 
-	router.Use(apiLimitIP())
+	router.Use(apiAccess())
+	router.Use(apiLimitIP(cfg.Limits.IP))
 
-	// Remote api total aggregate rate limits
-	globalRmtLimitHandler := apiRmtLimit(10)
+	// Remote api total aggregate rate limits, adjusted to what osu! reports
+	globalRmtLimitHandler := apiRmtLimit("global", upstreamLimit.limiter, endpointLimits.queue("global", upstreamLimit.limiter, cfg.Limits.Remote))
 
 	handlers := handlersMap()
 	for _, handlerCFG := range cfg.APIServer.Endpoints {
 		handler, exists := handlers[handlerCFG.Handler]
 		if !exists {
-			panic(fmt.Sprint("Endpoint does not exist", handlerCFG.Handler))
+			return nil, fmt.Errorf("endpoint %v does not exist", handlerCFG.Handler)
 		}
 		// Remove used handlers so we have a list of unused ones
 		delete(handlers, handlerCFG.Handler)
@@ -95,33 +170,60 @@ func apiServer(db *sql.DB, cache *clientv3.Client, cfg config, wg *sync.WaitGrou
 		}
 
 		// Local endpoint specific rate limits
-		var lclLimitHandler gin.HandlerFunc = apiNoLimit()
+		var lclLimitHandler gin.HandlerFunc
+		if handlerCFG.LocalLimit != nil {
+			lclLimitHandler = apiLclLimit(handler.name, endpointLimits.limiter("local", handler.name, *handlerCFG.LocalLimit))
+		} else {
+			lclLimitHandler = apiNoLimit()
+		}
 
-		// Remote endpoint specific rate limits
+		// Remote endpoint specific rate limits, the config overrides the handler's default
+		rmtLimit := handler.rmtLimit
+		if handlerCFG.RemoteLimit != nil {
+			rmtLimit = handlerCFG.RemoteLimit
+		}
 		var rmtLimitHandler gin.HandlerFunc
-		if handler.rmtLimit != nil {
-			rmtLimitHandler = apiRmtLimit(*handler.rmtLimit)
+		if rmtLimit != nil {
+			limiter := endpointLimits.limiter("remote", handler.name, *rmtLimit)
+			rmtLimitHandler = apiRmtLimit(handler.name, limiter, endpointLimits.queue(handler.name, limiter, *rmtLimit))
 		} else {
 			rmtLimitHandler = apiNoLimit()
 		}
 
-		fmt.Println("Using endpoint", handlerCFG.Handler, handler.lclEndpoint)
+		cost := int64(1)
+		if handlerCFG.Cost != nil {
+			cost = *handlerCFG.Cost
+		}
+
+		logger.WithFields(logrus.Fields{"handler": handlerCFG.Handler, "path": handler.lclEndpoint}).Info("Using endpoint")
 		if cfg.APIServer.PublicCache {
-			router.GET(handler.lclEndpoint, lclLimitHandler, cacheHandler, apiLimitKey(), apiAuth(db), rmtLimitHandler, globalRmtLimitHandler, apiHandler(handler))
+			router.GET(handler.lclEndpoint, apiMetrics(handler.name), apiUsage(handler.name), lclLimitHandler, apiKeyStatus(), cacheHandler, apiAuth(db), apiLimitKey(db, cost), rmtLimitHandler, globalRmtLimitHandler, apiHandler(handler))
 		} else {
-			router.GET(handler.lclEndpoint, lclLimitHandler, apiLimitKey(), apiAuth(db), cacheHandler, rmtLimitHandler, globalRmtLimitHandler, apiHandler(handler))
+			router.GET(handler.lclEndpoint, apiMetrics(handler.name), apiUsage(handler.name), lclLimitHandler, apiAuth(db), apiLimitKey(db, cost), cacheHandler, rmtLimitHandler, globalRmtLimitHandler, apiHandler(handler))
 		}
 		// TODO: Synchronisation to prevent duplicate work
 	}
 
+	// Management of the calling key, other keys are managed on the dashboard
+	key := router.Group("/api/v1/key", apiAuth(db), apiLimitKey(db, 0))
+	key.GET("", keyInfoHandler(db))
+	key.POST("/regenerate", keyRegenerateHandler(db, &cfg))
+	key.DELETE("", keyRevokeHandler(db))
+
+	// Allow and deny lists, disabled unless an admin token is configured
+	admin := router.Group("/api/v1/admin", requireAdmin(&cfg.Admin))
+	admin.GET("/access", accessListHandler(db))
+	admin.POST("/access", accessSaveHandler(db))
+	admin.DELETE("/access/:id", accessDeleteHandler(db))
+	admin.GET("/usage", usageReportHandler(db, false))
+	admin.GET("/usage.csv", usageReportHandler(db, true))
+
 	for _, handler := range handlers {
-		fmt.Println("Disabling endpoint", handler)
+		logger.WithFields(logrus.Fields{"handler": handler.name, "path": handler.lclEndpoint}).Info("Disabling endpoint")
 		router.GET(handler.lclEndpoint, func(c *gin.Context) {
 			c.File("html/disabled.json")
 		})
 	}
 
-	router.Run(cfg.APIServer.Address)
-
-	wg.Done()
+	return router, nil
 }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// sleepContext waits for d and reports false if ctx was cancelled in the meantime
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+type namedServer struct {
+	name   string
+	server *http.Server
+}
+
+// serve binds all servers before serving any, so a taken port fails the start instead of going unnoticed
+// Errors of servers that stop unexpectedly are sent to the returned channel
+func serve(servers []namedServer) (<-chan error, error) {
+	listeners := make([]net.Listener, len(servers))
+	for i, s := range servers {
+		listener, err := net.Listen("tcp", s.server.Addr)
+		if err != nil {
+			for _, l := range listeners[:i] {
+				l.Close()
+			}
+			return nil, fmt.Errorf("%v server couldn't listen on %v. %v", s.name, s.server.Addr, err)
+		}
+		listeners[i] = listener
+	}
+
+	errs := make(chan error, len(servers))
+	for i, s := range servers {
+		go func(s namedServer, listener net.Listener) {
+			logger.WithField("address", s.server.Addr).Info("Starting " + s.name + " server")
+			if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+				errs <- fmt.Errorf("%v server stopped. %v", s.name, err)
+			}
+		}(s, listeners[i])
+	}
+
+	return errs, nil
+}
+
+// shutdown lets in-flight requests finish until the timeout runs out
+func shutdown(servers []namedServer, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	wg := new(sync.WaitGroup)
+	for _, s := range servers {
+		wg.Add(1)
+		go func(s namedServer) {
+			defer wg.Done()
+			if err := s.server.Shutdown(ctx); err != nil {
+				logger.WithError(err).Warn("Couldn't drain " + s.name + " server in time")
+				s.server.Close()
+			}
+		}(s)
+	}
+	wg.Wait()
+}
@@ -1,26 +1,33 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"database/sql"
+	"math"
 	"net/http"
-	"strings"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/time/rate"
 )
 
-func apiLimitIP() gin.HandlerFunc {
+func apiLimitIP(cfg limitConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		ip := getIP(c)
-		ipLimiter := getVisitor(ipVisitors, ip)
+		ipLimiter := getVisitorWithLimiter(ipVisitors, ip, cfg.newLimiter())
+		updateLimiter(ipLimiter, cfg.limit(), cfg.Burst)
 
-		if !ipLimiter.Allow() {
-			c.String(http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests))
-			fmt.Println("Ip over rate limit", ip)
+		_, span := startSpan(c, "limit ip")
+		res := limits.allow("ip", ip, ipLimiter)
+		endLimitSpan(span, res)
+		setRateLimitHeaders(c, res)
+		if !res.Allowed {
+			rejectRateLimited(c, http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests), res.RetryAfter)
+			requestLog(c).WithField("ip", ip).Info("Ip over rate limit")
 			apiRateLimitedIP.Inc()
-			c.Abort()
 			return
 		}
 
@@ -28,19 +35,20 @@ func apiLimitIP() gin.HandlerFunc {
 	}
 }
 
-func apiLimitAuth() gin.HandlerFunc {
+func apiLimitAuth(cfg limitConfig) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		interval := rate.Every(30 * time.Second)
-		defaultLimiter := rate.NewLimiter(interval, 1)
-
 		ip := getIP(c)
-		limiter := getVisitorWithLimiter(authVisitors, ip, defaultLimiter)
+		limiter := getVisitorWithLimiter(authVisitors, ip, cfg.newLimiter())
+		updateLimiter(limiter, cfg.limit(), cfg.Burst)
 
-		if !limiter.Allow() {
-			c.String(http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests))
-			fmt.Println("Ip over rate limit", ip)
+		_, span := startSpan(c, "limit auth")
+		res := limits.allow("auth", ip, limiter)
+		endLimitSpan(span, res)
+		setRateLimitHeaders(c, res)
+		if !res.Allowed {
+			rejectRateLimited(c, http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests), res.RetryAfter)
+			requestLog(c).WithField("ip", ip).Info("Ip over rate limit")
 			apiRateLimitedIP.Inc()
-			c.Abort()
 			return
 		}
 
@@ -48,43 +56,169 @@ func apiLimitAuth() gin.HandlerFunc {
 	}
 }
 
-func apiLimitKey() gin.HandlerFunc {
+// apiLimitKey applies the tier of a key and charges cost against its quotas, 0 doesn't count towards them
+// It goes after apiAuth, so made up keys never get limiter or quota state
+func apiLimitKey(db *sql.DB, cost int64) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		// Keyed by hash so raw keys aren't kept around and the dashboard can find them
+		_, span := startSpan(c, "limit key")
+
 		key := c.GetHeader("api-key")
-		apiLimiter := getVisitor(apiVisitors, key)
+		keyHash := hashKey(key)
+		tier := keyTiers.get(db, keyHash)
+		span.SetAttributes(attribute.String("ratelimit.tier", tier.Name))
 
-		if !apiLimiter.Allow() {
-			c.String(http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests))
-			fmt.Println("Api key over rate limit", key)
+		apiLimiter := getVisitorWithLimiter(apiVisitors, keyHash, rate.NewLimiter(tier.Rate, tier.Burst))
+		// Tiers can change while the visitor is around
+		updateLimiter(apiLimiter, tier.Rate, tier.Burst)
+
+		res := limits.allow("key", keyHash, apiLimiter)
+		apiVisitors.remember(keyHash, res)
+		span.SetAttributes(attribute.Bool("ratelimit.allowed", res.Allowed), attribute.Int("ratelimit.remaining", res.Remaining))
+		setLimitHeaders(c, res)
+		setRateLimitHeaders(c, res)
+		if !res.Allowed {
+			span.End()
+			rejectRateLimited(c, http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests), res.RetryAfter)
+			requestLog(c).WithField("key_prefix", keyPrefix(key)).Info("Api key over rate limit")
 			apiRateLimitedKey.Inc()
-			c.Abort()
 			return
 		}
 
+		if cost > 0 {
+			statuses, ok := quotas.take(db, keyHash, tier, cost)
+			setQuotaHeaders(c, statuses)
+			span.SetAttributes(attribute.Bool("quota.allowed", ok))
+			if !ok {
+				span.End()
+				reset := quotaReset(statuses)
+				rejectRateLimited(c, http.StatusTooManyRequests, "Quota exceeded, resets at "+reset.Format(time.RFC3339), time.Until(reset))
+				requestLog(c).WithField("key_prefix", keyPrefix(key)).Info("Api key over quota")
+				apiQuotaExceeded.Inc()
+				return
+			}
+		}
+		span.End()
+
 		c.Next()
+
+		// Requests turned away further down or failing upstream don't use up the quota
+		if _, answered := c.Get("value"); cost > 0 && !answered && c.GetString("cache") != "hit" {
+			quotas.refund(keyHash, cost)
+		}
+	}
+}
+
+// apiKeyStatus reports the limits of keys seen recently, without any lookups, so that responses
+// from the public cache, which are served before authentication, carry them as well
+func apiKeyStatus() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key := c.GetHeader("api-key"); key != "" {
+			keyHash := hashKey(key)
+			if tier, known := keyTiers.cached(keyHash); known {
+				if res, exists := apiVisitors.recall(keyHash); exists {
+					setLimitHeaders(c, res)
+				}
+				setQuotaHeaders(c, quotas.peek(keyHash, tier))
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// updateLimiter applies changed limits to a visitor's existing limiter
+func updateLimiter(limiter *rate.Limiter, limit rate.Limit, burst int) {
+	if limiter.Limit() != limit {
+		limiter.SetLimit(limit)
+	}
+	if limiter.Burst() != burst {
+		limiter.SetBurst(burst)
+	}
+}
+
+func setLimitHeaders(c *gin.Context, res limitResult) {
+	c.Header("X-RateLimit-Limit", strconv.Itoa(res.Limit))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	c.Header("X-RateLimit-Reset", strconv.Itoa(int(math.Ceil(res.Reset.Seconds()))))
+}
+
+// setRateLimitHeaders reports the most restrictive of the local limits a request went through
+func setRateLimitHeaders(c *gin.Context, res limitResult) {
+	if prev, exists := c.Get("rateLimit"); exists {
+		p := prev.(limitResult)
+		if p.Remaining < res.Remaining || (p.Remaining == res.Remaining && p.Reset >= res.Reset) {
+			return
+		}
 	}
+	c.Set("rateLimit", res)
+
+	c.Header("RateLimit-Limit", strconv.Itoa(res.Limit))
+	c.Header("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	c.Header("RateLimit-Reset", strconv.Itoa(int(math.Ceil(res.Reset.Seconds()))))
 }
 
-func apiLclLimit(limit rate.Limit) gin.HandlerFunc {
-	limiter := rate.NewLimiter(limit, 1)
+func rejectRateLimited(c *gin.Context, status int, message string, retryAfter time.Duration) {
+	// Clients shouldn't retry immediately even if the limiter is almost ready
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.String(status, message)
+	c.Abort()
+}
 
+func apiLclLimit(name string, limiter *rate.Limiter) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if !limiter.Allow() {
-			c.String(http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests))
-			c.Abort()
+		_, span := startSpan(c, "limit local "+name)
+		res := limits.allow("local", name, limiter)
+		endLimitSpan(span, res)
+		setRateLimitHeaders(c, res)
+		if !res.Allowed {
+			rejectRateLimited(c, http.StatusTooManyRequests, http.StatusText(http.StatusTooManyRequests), res.RetryAfter)
 			return
 		}
 		c.Next()
 	}
 }
 
-func apiRmtLimit(limit rate.Limit) gin.HandlerFunc {
-	limiter := rate.NewLimiter(limit, 1)
-
+// Remote limits protect the upstream budget shared by everyone, so they don't show up in the headers
+// Without a queue, requests over the limit are turned away right away
+func apiRmtLimit(name string, limiter *rate.Limiter, queue *upstreamQueue) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		if !limiter.Allow() {
-			c.String(http.StatusOK, "Server rate limited :(")
-			c.Abort()
+		ctx, span := startSpan(c, "limit remote "+name)
+
+		if queue == nil {
+			res := limits.allow("remote", name, limiter)
+			span.SetAttributes(attribute.Bool("ratelimit.allowed", res.Allowed))
+			span.End()
+			if !res.Allowed {
+				rejectRateLimited(c, http.StatusTooManyRequests, "Server rate limited :(", res.RetryAfter)
+				apiRateLimitedRemote.Inc()
+				return
+			}
+			c.Next()
+			return
+		}
+
+		// Requests that are already waiting go first
+		if queue.len() == 0 && limits.allow("remote", name, limiter).Allowed {
+			span.SetAttributes(attribute.Bool("ratelimit.allowed", true))
+			span.End()
+			c.Next()
+			return
+		}
+
+		span.SetAttributes(attribute.Int("queue.depth", queue.len()))
+		allowed := queue.wait(ctx, strconv.FormatInt(c.GetInt64("keyID"), 10))
+		span.SetAttributes(attribute.Bool("ratelimit.allowed", allowed))
+		span.End()
+		if !allowed {
+			rejectRateLimited(c, http.StatusServiceUnavailable, "Server busy, try again later", queue.retryAfter())
+			apiRateLimitedRemote.Inc()
+			upstreamQueueRejected.WithLabelValues(name).Inc()
 			return
 		}
 		c.Next()
@@ -97,10 +231,91 @@ func apiNoLimit() gin.HandlerFunc {
 	}
 }
 
+// endpointLimiters keeps the limiters and queues of endpoints across config reloads,
+// so a reload neither hands out fresh bursts nor strands requests in an old queue
+type endpointLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*rate.Limiter
+	queues   map[string]*upstreamQueue
+	// Names asked for since the last prune, everything else belongs to removed endpoints
+	used map[string]bool
+}
+
+var endpointLimits = &endpointLimiters{
+	limiters: make(map[string]*rate.Limiter),
+	queues:   make(map[string]*upstreamQueue),
+	used:     make(map[string]bool),
+}
+
+// limiter returns the endpoint's limiter with cfg applied
+func (el *endpointLimiters) limiter(kind string, name string, cfg limitConfig) *rate.Limiter {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	key := kind + " " + name
+	el.used[key] = true
+	limiter, exists := el.limiters[key]
+	if !exists {
+		limiter = cfg.newLimiter()
+		el.limiters[key] = limiter
+		return limiter
+	}
+	updateLimiter(limiter, cfg.limit(), cfg.Burst)
+
+	return limiter
+}
+
+// queue returns the queue in front of a remote limiter, nil if cfg doesn't ask for one
+func (el *endpointLimiters) queue(name string, limiter *rate.Limiter, cfg limitConfig) *upstreamQueue {
+	if cfg.QueueSize <= 0 {
+		return nil
+	}
+
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	el.used["queue "+name] = true
+	queue, exists := el.queues[name]
+	if exists && queue.limiter == limiter {
+		queue.configure(cfg.QueueSize, cfg.MaxWait)
+		return queue
+	}
+	if exists {
+		queue.stop()
+	}
+
+	queue = newUpstreamQueue(name, limiter, cfg.QueueSize, cfg.MaxWait)
+	el.queues[name] = queue
+	return queue
+}
+
+// prune drops what the current routers don't use anymore, to be called once they're in place
+func (el *endpointLimiters) prune() {
+	el.mu.Lock()
+	defer el.mu.Unlock()
+
+	for key := range el.limiters {
+		if !el.used[key] {
+			delete(el.limiters, key)
+		}
+	}
+	for name, queue := range el.queues {
+		if !el.used["queue "+name] {
+			queue.stop()
+			delete(el.queues, name)
+			upstreamQueueDepth.DeleteLabelValues(name)
+		}
+	}
+	el.used = make(map[string]bool)
+}
+
 // Stolen from here https://www.alexedwards.net/blog/how-to-rate-limit-http-requests
 type visitor struct {
 	limiter  *rate.Limiter
 	lastSeen time.Time
+	// The outcome of the visitor's last request, shared limits don't show in the local limiter
+	last   limitResult
+	lastAt time.Time
 }
 
 type visitors struct {
@@ -112,23 +327,88 @@ var apiVisitors = &visitors{}
 var ipVisitors = &visitors{}
 var authVisitors = &visitors{}
 
-func getVisitor(vs *visitors, key string) *rate.Limiter {
-	return getVisitorWithLimiter(vs, key, rate.NewLimiter(2, 3))
-}
-
 func getVisitorWithLimiter(vs *visitors, key string, limiter *rate.Limiter) *rate.Limiter {
 	vs.mu.Lock()
 	defer vs.mu.Unlock()
 
 	v, exists := vs.visitors[key]
 	if !exists {
-		vs.visitors[key] = &visitor{limiter, time.Now()}
+		vs.visitors[key] = &visitor{limiter: limiter, lastSeen: time.Now()}
 		return limiter
 	}
 	v.lastSeen = time.Now()
 	return v.limiter
 }
 
+func (vs *visitors) remember(key string, res limitResult) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	if v, exists := vs.visitors[key]; exists {
+		v.last = res
+		v.lastAt = time.Now()
+	}
+}
+
+// recall estimates the visitor's limit state from its last request without counting as one
+func (vs *visitors) recall(key string) (limitResult, bool) {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	v, exists := vs.visitors[key]
+	if !exists || v.lastAt.IsZero() {
+		return limitResult{}, false
+	}
+
+	res := v.last
+	elapsed := time.Since(v.lastAt)
+	res.Reset -= elapsed
+	if res.Reset < 0 {
+		res.Reset = 0
+	}
+	res.RetryAfter -= elapsed
+	if res.RetryAfter < 0 {
+		res.RetryAfter = 0
+	}
+	res.Allowed = res.RetryAfter == 0
+	if limit := v.limiter.Limit(); limit != rate.Inf {
+		res.Remaining += int(elapsed.Seconds() * float64(limit))
+	}
+	if res.Remaining > res.Limit || res.Reset == 0 {
+		res.Remaining = res.Limit
+	}
+
+	return res, true
+}
+
+type limitStatus struct {
+	Limit     float64
+	Burst     int
+	Limited   bool
+	RetryIn   time.Duration
+	RecentUse bool
+}
+
+// visitorStatus reports the limit state of a visitor from its last request, which also covers the shared limiter store
+func visitorStatus(vs *visitors, key string, limit rate.Limit, burst int) limitStatus {
+	status := limitStatus{Limit: float64(limit), Burst: burst}
+
+	if res, exists := vs.recall(key); exists {
+		status.Limited = !res.Allowed
+		status.RetryIn = res.RetryAfter
+		status.RecentUse = true
+	}
+
+	return status
+}
+
+func (vs *visitors) len() int {
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	return len(vs.visitors)
+}
+
 func setupVisitors() {
 	apiVisitors.visitors = make(map[string]*visitor)
 	ipVisitors.visitors = make(map[string]*visitor)
@@ -145,18 +425,11 @@ func cleanupVisitors(vs *visitors) {
 	vs.mu.Unlock()
 }
 
-func cleanupVisitorsRoutine() {
-	for {
-		time.Sleep(time.Minute)
-
+func cleanupVisitorsRoutine(ctx context.Context) {
+	for sleepContext(ctx, time.Minute) {
 		cleanupVisitors(apiVisitors)
 		cleanupVisitors(ipVisitors)
 		cleanupVisitors(authVisitors)
+		keyTiers.cleanup()
 	}
 }
-
-func getIP(c *gin.Context) string {
-	forwarded := c.GetHeader("X-Forwarded-For")
-	ips := strings.Split(forwarded, ",")
-	return ips[len(ips)-1]
-}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// Limiter state is dropped by the store once the lease it was written with expires
+	limitLeaseTTL      = 10 * time.Minute
+	limitLeaseRotation = 5 * time.Minute
+	// Requests shouldn't wait long on the store, the local limiter is used instead
+	limitStoreTimeout = 250 * time.Millisecond
+	// After a failure the store is skipped for a while so it isn't hammered
+	limitStoreBackoff = 10 * time.Second
+	// Replicas updating the same bucket back off a little before trying again
+	limitContentionRetries = 3
+	limitContentionJitter  = 5 * time.Millisecond
+	// Still contended after that, the request is turned away but may come back right away
+	limitContentionRetryAfter = 50 * time.Millisecond
+)
+
+type limitResult struct {
+	Allowed    bool
+	RetryAfter time.Duration
+	// Size of the bucket, what's left of it and how long until it's full again
+	Limit     int
+	Remaining int
+	Reset     time.Duration
+}
+
+// limiterStore keeps token buckets that are shared between all replicas
+type limiterStore interface {
+	allow(ctx context.Context, key string, limit rate.Limit, burst int) (limitResult, error)
+}
+
+// etcdLimiterStore implements the generic cell rate algorithm on top of etcd transactions
+// The stored value is the theoretical arrival time of the next request
+// Note that clocks of replicas should be reasonably in sync
+type etcdLimiterStore struct {
+	client       *clientv3.Client
+	mu           sync.Mutex
+	lease        clientv3.LeaseID
+	leaseCreated time.Time
+}
+
+func newEtcdLimiterStore(client *clientv3.Client) *etcdLimiterStore {
+	return &etcdLimiterStore{client: client}
+}
+
+func (s *etcdLimiterStore) currentLease(ctx context.Context) (clientv3.LeaseID, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.lease != 0 && time.Since(s.leaseCreated) < limitLeaseRotation {
+		return s.lease, nil
+	}
+
+	resp, err := s.client.Grant(ctx, int64(limitLeaseTTL.Seconds()))
+	if err != nil {
+		return 0, fmt.Errorf("couldn't grant lease. %v", err)
+	}
+	s.lease = resp.ID
+	s.leaseCreated = time.Now()
+
+	return s.lease, nil
+}
+
+func (s *etcdLimiterStore) allow(ctx context.Context, key string, limit rate.Limit, burst int) (limitResult, error) {
+	if limit == rate.Inf {
+		return limitResult{Allowed: true, Limit: burst, Remaining: burst}, nil
+	}
+	if limit <= 0 {
+		return limitResult{Limit: burst}, nil
+	}
+
+	key = "ratelimit/" + key
+	emission := time.Duration(float64(time.Second) / float64(limit))
+
+	// Retry a few times if other replicas update the same bucket concurrently
+	for attempt := 0; attempt < limitContentionRetries; attempt++ {
+		if attempt > 0 && !sleepContext(ctx, time.Duration(rand.Int63n(int64(limitContentionJitter)))) {
+			break
+		}
+
+		resp, err := s.client.Get(ctx, key)
+		if err != nil {
+			return limitResult{}, fmt.Errorf("couldn't get limiter state. %v", err)
+		}
+
+		now := time.Now()
+		var tat time.Time
+		cmp := clientv3.Compare(clientv3.CreateRevision(key), "=", 0)
+		if len(resp.Kvs) > 0 {
+			if stored, err := strconv.ParseInt(string(resp.Kvs[0].Value), 10, 64); err == nil {
+				tat = time.Unix(0, stored)
+			}
+			cmp = clientv3.Compare(clientv3.ModRevision(key), "=", resp.Kvs[0].ModRevision)
+		}
+
+		newTat, res := gcra(now, tat, emission, burst)
+		if !res.Allowed {
+			return res, nil
+		}
+
+		lease, err := s.currentLease(ctx)
+		if err != nil {
+			return limitResult{}, err
+		}
+
+		txn, err := s.client.Txn(ctx).
+			If(cmp).
+			Then(clientv3.OpPut(key, strconv.FormatInt(newTat.UnixNano(), 10), clientv3.WithLease(lease))).
+			Commit()
+		if err != nil {
+			return limitResult{}, fmt.Errorf("couldn't update limiter state. %v", err)
+		}
+		if txn.Succeeded {
+			return res, nil
+		}
+	}
+
+	// The store works, the bucket is just busy, so this counts against the limit instead of
+	// falling back to local limits that would let every replica grant the full limit
+	limitStoreContention.Inc()
+	return limitResult{RetryAfter: limitContentionRetryAfter, Limit: burst}, nil
+}
+
+// gcra decides on a request arriving at now, given the stored theoretical arrival time
+// Allowed requests return the arrival time to store, a bucket of burst requests refills one every emission
+func gcra(now time.Time, tat time.Time, emission time.Duration, burst int) (time.Time, limitResult) {
+	if tat.Before(now) {
+		tat = now
+	}
+	tolerance := emission * time.Duration(burst)
+
+	newTat := tat.Add(emission)
+	if newTat.Sub(now) > tolerance {
+		return tat, limitResult{
+			RetryAfter: newTat.Sub(now) - tolerance,
+			Limit:      burst,
+			Reset:      tat.Sub(now),
+		}
+	}
+
+	return newTat, limitResult{
+		Allowed:   true,
+		Limit:     burst,
+		Remaining: int((tolerance - newTat.Sub(now)) / emission),
+		Reset:     newTat.Sub(now),
+	}
+}
+
+// sharedLimits enforces limits through the store if there is one and the local limiters otherwise
+type sharedLimits struct {
+	store     limiterStore
+	mu        sync.Mutex
+	downUntil time.Time
+}
+
+var limits = &sharedLimits{}
+
+func setupLimitStore(cfg *limitsConfig, cache *clientv3.Client) {
+	switch cfg.Backend {
+	case "etcd":
+		limits.store = newEtcdLimiterStore(cache)
+	default:
+		limits.store = nil
+	}
+}
+
+func (l *sharedLimits) storeAvailable() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.store != nil && time.Now().After(l.downUntil)
+}
+
+func (l *sharedLimits) storeFailed(err error) {
+	logger.WithError(err).Warn("Rate limit store unavailable, using local limits")
+	limitStoreFallbacks.Inc()
+
+	l.mu.Lock()
+	l.downUntil = time.Now().Add(limitStoreBackoff)
+	l.mu.Unlock()
+}
+
+// allow checks the bucket name/key, the local limiter provides the limits and acts as fallback
+func (l *sharedLimits) allow(name string, key string, local *rate.Limiter) limitResult {
+	if l.storeAvailable() {
+		ctx, cancel := context.WithTimeout(context.Background(), limitStoreTimeout)
+		defer cancel()
+
+		res, err := l.store.allow(ctx, name+"/"+key, local.Limit(), local.Burst())
+		if err == nil {
+			return res
+		}
+		l.storeFailed(err)
+	}
+
+	return allowLocal(local)
+}
+
+func allowLocal(local *rate.Limiter) limitResult {
+	now := time.Now()
+	res := limitResult{Limit: local.Burst()}
+
+	r := local.ReserveN(now, 1)
+	if !r.OK() {
+		return res
+	}
+	if delay := r.DelayFrom(now); delay > 0 {
+		r.CancelAt(now)
+		res.RetryAfter = delay
+	} else {
+		res.Allowed = true
+	}
+
+	tokens := local.TokensAt(now)
+	if tokens > 0 {
+		res.Remaining = int(tokens)
+	}
+	if local.Limit() > 0 && local.Limit() != rate.Inf {
+		missing := float64(local.Burst()) - tokens
+		res.Reset = time.Duration(missing / float64(local.Limit()) * float64(time.Second))
+	}
+
+	return res
+}
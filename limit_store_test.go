@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestGCRASequence(t *testing.T) {
+	start := time.Unix(1000, 0)
+	emission := time.Second
+
+	tests := []struct {
+		name       string
+		at         time.Duration // since start
+		allowed    bool
+		remaining  int
+		retryAfter time.Duration
+		reset      time.Duration
+	}{
+		{"first request", 0, true, 2, 0, time.Second},
+		{"second request", 0, true, 1, 0, 2 * time.Second},
+		{"burst used up", 0, true, 0, 0, 3 * time.Second},
+		{"over the burst", 0, false, 0, time.Second, 3 * time.Second},
+		{"still over", 500 * time.Millisecond, false, 0, 500 * time.Millisecond, 2500 * time.Millisecond},
+		{"one refilled", time.Second, true, 0, 0, 3 * time.Second},
+		{"idle refills the bucket", 10 * time.Second, true, 2, 0, time.Second},
+	}
+
+	var tat time.Time
+	for _, tt := range tests {
+		newTat, res := gcra(start.Add(tt.at), tat, emission, 3)
+		if res.Allowed != tt.allowed || res.Remaining != tt.remaining || res.RetryAfter != tt.retryAfter || res.Reset != tt.reset {
+			t.Fatalf("%v: got %+v, want allowed %v remaining %v retry after %v reset %v",
+				tt.name, res, tt.allowed, tt.remaining, tt.retryAfter, tt.reset)
+		}
+		if res.Limit != 3 {
+			t.Fatalf("%v: got limit %v, want 3", tt.name, res.Limit)
+		}
+		if !res.Allowed && !newTat.Equal(tat) && !tat.IsZero() {
+			t.Fatalf("%v: denied requests shouldn't move the arrival time", tt.name)
+		}
+		tat = newTat
+	}
+}
+
+func TestGCRAStaleArrivalTime(t *testing.T) {
+	now := time.Unix(1000, 0)
+
+	// An arrival time long in the past is as good as an empty bucket
+	tat, res := gcra(now, now.Add(-time.Hour), 100*time.Millisecond, 5)
+	if !res.Allowed || res.Remaining != 4 {
+		t.Fatalf("got %+v, want allowed with 4 remaining", res)
+	}
+	if want := now.Add(100 * time.Millisecond); !tat.Equal(want) {
+		t.Fatalf("got arrival time %v, want %v", tat, want)
+	}
+}
+
+type fakeLimiterStore struct {
+	res limitResult
+	err error
+}
+
+func (s *fakeLimiterStore) allow(ctx context.Context, key string, limit rate.Limit, burst int) (limitResult, error) {
+	return s.res, s.err
+}
+
+func TestSharedLimitsFallback(t *testing.T) {
+	tests := []struct {
+		name     string
+		store    *fakeLimiterStore
+		allowed  bool
+		fellBack bool
+	}{
+		{"store allows", &fakeLimiterStore{res: limitResult{Allowed: true}}, true, false},
+		{"store denies", &fakeLimiterStore{res: limitResult{RetryAfter: limitContentionRetryAfter}}, false, false},
+		{"store fails", &fakeLimiterStore{err: fmt.Errorf("unavailable")}, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &sharedLimits{store: tt.store}
+			res := l.allow("test", "key", rate.NewLimiter(1, 1))
+			if res.Allowed != tt.allowed {
+				t.Fatalf("got allowed %v, want %v", res.Allowed, tt.allowed)
+			}
+			if fellBack := !l.storeAvailable(); fellBack != tt.fellBack {
+				t.Fatalf("got store skipped %v, want %v", fellBack, tt.fellBack)
+			}
+		})
+	}
+}
+
+func TestAllowLocal(t *testing.T) {
+	limiter := rate.NewLimiter(1, 2)
+
+	first := allowLocal(limiter)
+	second := allowLocal(limiter)
+	third := allowLocal(limiter)
+
+	if !first.Allowed || first.Remaining != 1 {
+		t.Fatalf("first: got %+v", first)
+	}
+	if !second.Allowed || second.Remaining != 0 {
+		t.Fatalf("second: got %+v", second)
+	}
+	if third.Allowed || third.RetryAfter <= 0 || third.RetryAfter > time.Second {
+		t.Fatalf("third: got %+v, want denied with a retry within a second", third)
+	}
+}
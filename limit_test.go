@@ -0,0 +1,49 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestVisitorStatus(t *testing.T) {
+	tests := []struct {
+		name      string
+		last      *limitResult
+		limited   bool
+		recentUse bool
+	}{
+		{"unknown visitor", nil, false, false},
+		{"allowed", &limitResult{Allowed: true, Limit: 3, Remaining: 2}, false, true},
+		{"limited by the shared store", &limitResult{RetryAfter: time.Minute, Limit: 3, Reset: time.Minute}, true, true},
+		{"limit over by now", &limitResult{RetryAfter: time.Nanosecond, Limit: 3}, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vs := &visitors{visitors: make(map[string]*visitor)}
+			// The local limiter never sees shared limits, so it has to be ignored
+			limiter := rate.NewLimiter(2, 3)
+			if tt.last != nil {
+				getVisitorWithLimiter(vs, "key", limiter)
+				vs.remember("key", *tt.last)
+			}
+			time.Sleep(time.Millisecond)
+
+			status := visitorStatus(vs, "key", 2, 3)
+			if status.Limited != tt.limited || status.RecentUse != tt.recentUse {
+				t.Fatalf("got %+v, want limited %v and recent use %v", status, tt.limited, tt.recentUse)
+			}
+			if status.Limit != 2 || status.Burst != 3 {
+				t.Fatalf("got limit %v and burst %v, want the tier's", status.Limit, status.Burst)
+			}
+			if tt.limited && (status.RetryIn <= 0 || status.RetryIn > time.Minute) {
+				t.Fatalf("got retry in %v, want up to a minute", status.RetryIn)
+			}
+			if limiter.Tokens() < 3 {
+				t.Fatalf("reading the status used up %v tokens", 3-limiter.Tokens())
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var logger = newLogger()
+
+func newLogger() *logrus.Logger {
+	l := logrus.New()
+	l.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	l.AddHook(redactHook{})
+	return l
+}
+
+func setupLogging(cfg *logConfig) error {
+	level := logrus.InfoLevel
+	if cfg.Level != "" {
+		var err error
+		if level, err = logrus.ParseLevel(cfg.Level); err != nil {
+			return fmt.Errorf("invalid log level %v", cfg.Level)
+		}
+	}
+	logger.SetLevel(level)
+
+	switch cfg.Format {
+	case "", "json":
+		logger.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano})
+	case "text":
+		logger.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	default:
+		return fmt.Errorf("invalid log format %v, use json or text", cfg.Format)
+	}
+
+	// Gin's route listing is only interesting when debugging
+	if level < logrus.DebugLevel {
+		gin.SetMode(gin.ReleaseMode)
+	}
+
+	return nil
+}
+
+var (
+	// Fields that must never end up in logs as they are
+	redactedFields = map[string]bool{
+		"api_key": true, "token": true, "access_token": true, "refresh_token": true, "secret": true, "code": true,
+	}
+	// Bearer tokens, osu! access tokens (JWTs) and api keys, which are long random strings
+	redactPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)bearer\s+\S+`),
+		regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`),
+		regexp.MustCompile(`\b[0-9A-Za-z]{40,}\b`),
+	}
+)
+
+func redact(s string) string {
+	for _, pattern := range redactPatterns {
+		s = pattern.ReplaceAllString(s, "[redacted]")
+	}
+	return s
+}
+
+// redactHook scrubs secrets from messages and fields before they are written
+type redactHook struct{}
+
+func (redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (redactHook) Fire(entry *logrus.Entry) error {
+	entry.Message = redact(entry.Message)
+
+	// Entries share their field map with the entry they were derived from
+	data := make(logrus.Fields, len(entry.Data))
+	for name, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			if redactedFields[strings.ToLower(name)] {
+				value = "[redacted]"
+			} else {
+				value = redact(v)
+			}
+		case error:
+			value = redact(v.Error())
+		}
+		data[name] = value
+	}
+	entry.Data = data
+
+	return nil
+}
+
+// requestLog returns a logger carrying the fields that identify the current request
+func requestLog(c *gin.Context) *logrus.Entry {
+	fields := logrus.Fields{"request_id": c.GetString("requestID")}
+
+	if handler := c.GetString("handler"); handler != "" {
+		fields["handler"] = handler
+	} else if path := c.FullPath(); path != "" {
+		fields["handler"] = path
+	}
+	if userID, exists := c.Get("userID"); exists {
+		fields["user_id"] = userID
+	}
+	if span := trace.SpanFromContext(c.Request.Context()).SpanContext(); span.IsValid() {
+		fields["trace_id"] = span.TraceID().String()
+	}
+
+	return logger.WithFields(fields)
+}
+
+// requestLogger assigns every request an id and logs it once it has been answered
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := requestID(c)
+		c.Set("requestID", id)
+		c.Header(requestIDHeader, id)
+
+		c.Next()
+
+		entry := requestLog(c).WithFields(logrus.Fields{
+			"method":     c.Request.Method,
+			"path":       c.Request.URL.Path,
+			"status":     c.Writer.Status(),
+			"latency_ms": time.Since(start).Milliseconds(),
+			"ip":         getIP(c),
+		})
+		if len(c.Errors) > 0 {
+			entry = entry.WithField("error", c.Errors.String())
+		}
+
+		if c.Writer.Status() >= 500 {
+			entry.Error("Request failed")
+		} else {
+			entry.Info("Request")
+		}
+	}
+}
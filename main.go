@@ -1,78 +1,178 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	_ "github.com/lib/pq"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
-func promServer(db *sql.DB, cfg config, wg *sync.WaitGroup) {
+func promServer(db *sql.DB, cache *clientv3.Client, cfg config) *http.Server {
 	mux := http.NewServeMux()
 
 	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.Handle("/readyz", readyzHandler(db, cache))
 
-	server := http.Server{
+	return &http.Server{
 		Addr:    cfg.PromServer.Address,
 		Handler: mux,
 	}
-
-	server.ListenAndServe()
-	wg.Done()
 }
 
 func main() {
-	cfg, err := getConfig()
+	// Commands that don't need the config or database, like check-config
+	if len(os.Args) > 1 {
+		if cmd, exists := commands[os.Args[1]]; exists && cmd.standalone {
+			if err := cmd.run(nil, config{}, os.Args[2:]); err != nil {
+				fmt.Println("Error: ", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
+	cfg, err := getConfig("")
 	if err != nil {
-		fmt.Println("Error: ", err)
+		logger.WithError(err).Fatal("Error reading config")
+	}
+
+	if err = validateConfig(&cfg); err != nil {
+		logger.WithError(err).Fatal("Invalid config, run `osu-api-proxy check-config` for details")
+	}
+
+	if err = setupLogging(&cfg.Log); err != nil {
+		panic(err)
 	}
 
 	db, err := sql.Open("postgres", cfg.Database.Dsn)
 	if err != nil {
 		panic(err.Error())
 	}
-	defer db.Close()
 
 	db.SetConnMaxLifetime(time.Minute * 3)
 	db.SetMaxOpenConns(10)
 	db.SetMaxIdleConns(10)
 
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS api_tokens (" +
-		"id INT PRIMARY KEY," +
-		"api_key CHAR(64) NOT NULL," +
-		"expiryTime timestamp NOT NULL," +
-		"accessToken TEXT NOT NULL," +
-		"refreshToken TEXT NOT NULL," +
-		"UNIQUE(api_key)" +
-		")")
+	err = setupDatabase(db)
 	if err != nil {
 		panic(err)
 	}
 
+	err = setupEncryption(&cfg.Encryption)
+	if err != nil {
+		panic(err)
+	}
+
+	if len(os.Args) > 1 {
+		if err := runCommand(db, cfg, os.Args[1:]); err != nil {
+			fmt.Println("Error: ", err)
+			os.Exit(1)
+		}
+		db.Close()
+		return
+	}
+
 	cache := setupCache(&cfg.EtcdConfig)
 
 	metricsInit()
 
+	shutdownTracing, err := setupTracing(&cfg.Tracing)
+	if err != nil {
+		panic(err)
+	}
+
 	uc, _ := getUserCount(db)
 	usersRegistered.Set(float64(uc))
 
 	setupVisitors()
+	if err = setupTrustedProxies(&cfg.Proxy); err != nil {
+		panic(err)
+	}
+	if err = setupTiers(db, cfg.Limits.Key); err != nil {
+		panic(err)
+	}
+	setupLimitStore(&cfg.Limits, cache)
+	setupUpstreamLimit(&cfg.Limits)
+	setKeysConfig(cfg.Keys)
+	if err = accessRules.reload(db); err != nil {
+		logger.WithError(err).Error("Error loading access rules")
+	}
 
-	// Refresh tokens now and daily
-	go refreshTokensRoutine(db, &cfg.APIConfig)
-	go cleanupVisitorsRoutine()
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+
+	// Background routines keep going until the servers are drained so the last usage gets saved
+	routinesCtx, stopRoutines := context.WithCancel(context.Background())
+	routines := new(sync.WaitGroup)
+	runRoutine := func(routine func(ctx context.Context)) {
+		routines.Add(1)
+		go func() {
+			defer routines.Done()
+			routine(routinesCtx)
+		}()
+	}
 
-	wg := new(sync.WaitGroup)
-	wg.Add(3)
+	// Refresh tokens shortly before they expire
+	runRoutine(func(ctx context.Context) { refreshTokensRoutine(ctx, db, &cfg.APIConfig) })
+	runRoutine(cleanupVisitorsRoutine)
+	runRoutine(func(ctx context.Context) { flushKeyUsageRoutine(ctx, db) })
+	runRoutine(func(ctx context.Context) { pruneKeysRoutine(ctx, db) })
+	runRoutine(func(ctx context.Context) { flushQuotasRoutine(ctx, db) })
+	runRoutine(func(ctx context.Context) { reloadAccessRulesRoutine(ctx, db) })
 
-	go authServer(db, cfg, wg)
-	go apiServer(db, cache, cfg, wg)
-	go promServer(db, cfg, wg)
+	apiRoutes, err := apiRouter(db, cache, cfg)
+	if err != nil {
+		panic(err)
+	}
+	endpointLimits.prune()
+	api := newReloadableHandler(apiRoutes)
+	auth := newReloadableHandler(authRouter(db, cache, cfg))
+	watchConfig(&cfg, db, cache, api, auth)
+
+	servers := []namedServer{
+		{"auth", &http.Server{Addr: cfg.Auth.Address, Handler: auth}},
+		{"api", &http.Server{Addr: cfg.APIServer.Address, Handler: api}},
+		{"metrics", promServer(db, cache, cfg)},
+	}
+
+	exitCode := 0
+	errs, err := serve(servers)
+	if err != nil {
+		stop()
+		logger.WithError(err).Error("Couldn't start servers")
+		exitCode = 1
+	} else {
+		select {
+		case <-ctx.Done():
+			logger.Info("Shutting down")
+		case err := <-errs:
+			logger.WithError(err).Error("Shutting down after server failure")
+			exitCode = 1
+		}
+		// Signals get their default handling back, so a second one ends the process without waiting for the shutdown
+		stop()
+		shutdown(servers, cfg.ShutdownTimeout)
+	}
+
+	stopRoutines()
+	routines.Wait()
+
+	if err = shutdownTracing(context.Background()); err != nil {
+		logger.WithError(err).Warn("Couldn't flush traces")
+	}
+	cache.Close()
+	db.Close()
 
-	wg.Wait()
+	logger.Info("Stopped")
+	os.Exit(exitCode)
 }
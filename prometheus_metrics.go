@@ -1,6 +1,13 @@
 package main
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 var (
 	apiRequestsBadAuth = prometheus.NewCounter(
@@ -21,6 +28,30 @@ var (
 			Help: "Number of api requests that were rate limited by api key.",
 		},
 	)
+	apiRateLimitedRemote = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "api_rate_limited_remote",
+			Help: "Number of api requests that were rejected to stay within the upstream rate limits.",
+		},
+	)
+	apiQuotaExceeded = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "api_quota_exceeded",
+			Help: "Number of api requests that were rejected because a key's quota was used up.",
+		},
+	)
+	limitStoreFallbacks = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "limit_store_fallbacks",
+			Help: "Number of times the shared rate limit store failed and local limits were used.",
+		},
+	)
+	limitStoreContention = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "limit_store_contention",
+			Help: "Number of requests turned away because other replicas kept updating the same rate limit.",
+		},
+	)
 	apiCallFailed = prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Name: "api_call_failed",
@@ -39,6 +70,73 @@ var (
 			Help: "Number of cached api requests.",
 		},
 	)
+	apiRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "api_requests",
+			Help: "Number of api requests by endpoint, status class and whether they were served from cache.",
+		},
+		[]string{"handler", "status", "cache"},
+	)
+	apiRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "api_request_duration_seconds",
+			Help:    "Time taken to answer api requests, including waiting for rate limits.",
+			Buckets: []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30},
+		},
+		[]string{"handler"},
+	)
+	upstreamRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "upstream_request_duration_seconds",
+			Help:    "Time taken by requests to osu!.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"handler"},
+	)
+	upstreamRequestsInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "upstream_requests_in_flight",
+			Help: "Number of requests to osu! that haven't been answered yet.",
+		},
+	)
+	upstreamQueueDepth = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "upstream_queue_depth",
+			Help: "Number of api requests waiting for room in an upstream rate limit.",
+		},
+		[]string{"limiter"},
+	)
+	upstreamQueueRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "upstream_queue_rejected",
+			Help: "Number of api requests that were rejected because an upstream queue was full or they waited too long.",
+		},
+		[]string{"limiter"},
+	)
+	upstreamEffectiveLimit = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "upstream_effective_limit",
+			Help: "Requests per second currently allowed to osu! after adapting to its responses.",
+		},
+	)
+	apiRequestsDenied = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "api_requests_denied",
+			Help: "Number of api requests that were rejected by the access rules.",
+		},
+	)
+	configReloads = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "config_reloads",
+			Help: "Number of times the config file was reloaded.",
+		},
+	)
+	configReloadsFailed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "config_reloads_failed",
+			Help: "Number of config file changes that were rejected.",
+		},
+	)
 	usersRegistered = prometheus.NewGauge(
 		prometheus.GaugeOpts{
 			Name: "users_registered",
@@ -51,15 +149,116 @@ var (
 			Help: "Number of times users manually refreshed tokens.",
 		},
 	)
+	keysMigrated = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "keys_migrated",
+			Help: "Number of clear text api keys that were hashed on first use.",
+		},
+	)
+	keysRegenerated = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "keys_regenerated",
+			Help: "Number of api keys that were regenerated.",
+		},
+	)
+	keysPruned = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "keys_pruned",
+			Help: "Number of api keys disabled after inactivity.",
+		},
+	)
+	usersDormant = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "users_dormant",
+			Help: "Number of users whose tokens stopped being refreshed for lack of usable keys.",
+		},
+	)
+	tokenRefreshSuccess = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "token_refresh_success",
+			Help: "Number of successful background token refreshes.",
+		},
+	)
+	tokenRefreshFailed = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "token_refresh_failed",
+			Help: "Number of failed background token refreshes.",
+		},
+	)
+	tokensRevoked = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "tokens_revoked",
+			Help: "Number of tokens marked as revoked after an invalid grant.",
+		},
+	)
 )
 
 func metricsInit() {
 	prometheus.MustRegister(apiRequestsBadAuth)
 	prometheus.MustRegister(apiRateLimitedIP)
 	prometheus.MustRegister(apiRateLimitedKey)
+	prometheus.MustRegister(apiRateLimitedRemote)
+	prometheus.MustRegister(apiQuotaExceeded)
+	prometheus.MustRegister(upstreamQueueDepth)
+	prometheus.MustRegister(upstreamQueueRejected)
+	prometheus.MustRegister(upstreamEffectiveLimit)
+	prometheus.MustRegister(apiRequestsDenied)
+	prometheus.MustRegister(limitStoreFallbacks)
+	prometheus.MustRegister(limitStoreContention)
 	prometheus.MustRegister(apiCallFailed)
 	prometheus.MustRegister(apiCallSuccess)
 	prometheus.MustRegister(apiCallCached)
 	prometheus.MustRegister(usersRegistered)
 	prometheus.MustRegister(tokensRefreshed)
+	prometheus.MustRegister(keysMigrated)
+	prometheus.MustRegister(keysRegenerated)
+	prometheus.MustRegister(keysPruned)
+	prometheus.MustRegister(usersDormant)
+	prometheus.MustRegister(tokenRefreshSuccess)
+	prometheus.MustRegister(tokenRefreshFailed)
+	prometheus.MustRegister(tokensRevoked)
+	prometheus.MustRegister(configReloads)
+	prometheus.MustRegister(configReloadsFailed)
+	prometheus.MustRegister(apiRequests)
+	prometheus.MustRegister(apiRequestDuration)
+	prometheus.MustRegister(upstreamRequestDuration)
+	prometheus.MustRegister(upstreamRequestsInFlight)
+
+	for name, vs := range map[string]*visitors{"key": apiVisitors, "ip": ipVisitors, "auth": authVisitors} {
+		vs := vs
+		prometheus.MustRegister(prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name:        "rate_limit_visitors",
+				Help:        "Number of clients currently tracked for rate limiting.",
+				ConstLabels: prometheus.Labels{"limit": name},
+			},
+			func() float64 { return float64(vs.len()) },
+		))
+	}
+}
+
+func statusClass(status int) string {
+	return strconv.Itoa(status/100) + "xx"
+}
+
+// apiMetrics records how long requests to an endpoint take and how they ended
+func apiMetrics(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Also names the handler in logs
+		c.Set("handler", name)
+		start := time.Now()
+		c.Next()
+
+		cache := c.GetString("cache")
+		if cache == "" {
+			cache = "none"
+		}
+		status := c.Writer.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		apiRequests.WithLabelValues(name, statusClass(status), cache).Inc()
+		apiRequestDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	}
 }
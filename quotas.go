@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Usage is written to the database in intervals rather than on every request
+	quotaFlushInterval = 10 * time.Second
+	// Counters are reloaded this often to see usage by other replicas
+	quotaReloadInterval = time.Minute
+	// Old usage rows are kept for a while for reference
+	quotaRetention = 62 * 24 * time.Hour
+)
+
+type quotaPeriod struct {
+	name   string
+	header string
+	start  func(now time.Time) time.Time
+	end    func(start time.Time) time.Time
+	quota  func(tier rateTier) int64
+}
+
+var quotaPeriods = []quotaPeriod{
+	{
+		name:   "daily",
+		header: "Daily",
+		start: func(now time.Time) time.Time {
+			return time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+		},
+		end:   func(start time.Time) time.Time { return start.AddDate(0, 0, 1) },
+		quota: func(tier rateTier) int64 { return tier.DailyQuota },
+	},
+	{
+		name:   "monthly",
+		header: "Monthly",
+		start: func(now time.Time) time.Time {
+			return time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+		},
+		end:   func(start time.Time) time.Time { return start.AddDate(0, 1, 0) },
+		quota: func(tier rateTier) int64 { return tier.MonthlyQuota },
+	},
+}
+
+type quotaCounter struct {
+	keyHash string
+	period  string
+	start   time.Time
+	used    int64 // as of the last load or flush, including other replicas
+	pending int64 // not written to the database yet
+	loaded  time.Time
+}
+
+type quotaStatus struct {
+	Period    quotaPeriod
+	Limit     int64
+	Remaining int64
+	Reset     time.Time
+	Exceeded  bool
+}
+
+type quotaTracker struct {
+	counters map[string]*quotaCounter
+	mu       sync.Mutex
+}
+
+var quotas = &quotaTracker{counters: make(map[string]*quotaCounter)}
+
+func loadQuotaUsage(db *sql.DB, keyHash string, period string, start time.Time) (int64, error) {
+	var used int64
+	err := db.QueryRow("SELECT q.used FROM key_quotas q JOIN api_keys k ON k.id = q.key_id "+
+		"WHERE k.key_hash = $1 AND q.period = $2 AND q.period_start = $3", keyHash, period, start).Scan(&used)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return used, err
+}
+
+func (q *quotaTracker) counter(db *sql.DB, keyHash string, p quotaPeriod, now time.Time) *quotaCounter {
+	start := p.start(now)
+	id := keyHash + "/" + p.name
+
+	q.mu.Lock()
+	c, exists := q.counters[id]
+	q.mu.Unlock()
+	if exists && c.start.Equal(start) {
+		return c
+	}
+
+	used, err := loadQuotaUsage(db, keyHash, p.name, start)
+	if err != nil {
+		// Better to let requests through than to block everyone while the database is down
+		logger.WithError(err).Error("Error loading quota usage")
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Another request may have loaded it in the meantime
+	if c, exists := q.counters[id]; exists && c.start.Equal(start) {
+		return c
+	}
+	// Usage of the previous period that wasn't flushed yet is kept under its own id
+	if exists && c.pending > 0 {
+		q.counters[id+"/"+c.start.Format("2006-01-02")] = c
+	}
+
+	c = &quotaCounter{keyHash: keyHash, period: p.name, start: start, used: used, loaded: now}
+	q.counters[id] = c
+	return c
+}
+
+// take charges cost against all quotas of a key and reports whether it fit
+// Nothing is charged if any of the quotas would be exceeded
+func (q *quotaTracker) take(db *sql.DB, keyHash string, tier rateTier, cost int64) ([]quotaStatus, bool) {
+	now := time.Now().UTC()
+
+	counters := make([]*quotaCounter, len(quotaPeriods))
+	for i, p := range quotaPeriods {
+		counters[i] = q.counter(db, keyHash, p, now)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var statuses []quotaStatus
+	allowed := true
+	for i, p := range quotaPeriods {
+		quota := p.quota(tier)
+		if quota <= 0 {
+			continue
+		}
+
+		used := counters[i].used + counters[i].pending
+		exceeded := used+cost > quota
+		if exceeded {
+			allowed = false
+		}
+		statuses = append(statuses, quotaStatus{
+			Period:    p,
+			Limit:     quota,
+			Remaining: quota - used,
+			Reset:     p.end(counters[i].start),
+			Exceeded:  exceeded,
+		})
+	}
+
+	if allowed {
+		for _, c := range counters {
+			// The counter may have been dropped by a flush since it was looked up
+			id := keyHash + "/" + c.period
+			if _, exists := q.counters[id]; !exists {
+				q.counters[id] = c
+			}
+			c.pending += cost
+		}
+		for i := range statuses {
+			statuses[i].Remaining -= cost
+		}
+	}
+	for i := range statuses {
+		if statuses[i].Remaining < 0 {
+			statuses[i].Remaining = 0
+		}
+	}
+
+	return statuses, allowed
+}
+
+// refund gives back what take charged for a request that didn't get an answer after all
+func (q *quotaTracker) refund(keyHash string, cost int64) {
+	now := time.Now().UTC()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, p := range quotaPeriods {
+		// Pending can go negative if the charge was written already, the next flush corrects it
+		if c, exists := q.counters[keyHash+"/"+p.name]; exists && c.start.Equal(p.start(now)) {
+			c.pending -= cost
+		}
+	}
+}
+
+// peek reports the quotas of a key as far as they're known in memory, without loading or charging anything
+func (q *quotaTracker) peek(keyHash string, tier rateTier) []quotaStatus {
+	now := time.Now().UTC()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var statuses []quotaStatus
+	for _, p := range quotaPeriods {
+		quota := p.quota(tier)
+		c, exists := q.counters[keyHash+"/"+p.name]
+		if quota <= 0 || !exists || !c.start.Equal(p.start(now)) {
+			continue
+		}
+
+		remaining := quota - c.used - c.pending
+		if remaining < 0 {
+			remaining = 0
+		}
+		statuses = append(statuses, quotaStatus{Period: p, Limit: quota, Remaining: remaining, Reset: p.end(c.start)})
+	}
+
+	return statuses
+}
+
+func (q *quotaTracker) flush(db *sql.DB) {
+	q.mu.Lock()
+	var pending []*quotaCounter
+	pendingAmounts := make(map[*quotaCounter]int64)
+	for id, c := range q.counters {
+		if c.pending != 0 {
+			pending = append(pending, c)
+			pendingAmounts[c] = c.pending
+		} else if time.Since(c.loaded) > quotaReloadInterval {
+			delete(q.counters, id)
+		}
+	}
+	q.mu.Unlock()
+
+	for _, c := range pending {
+		amount := pendingAmounts[c]
+
+		// Keys that don't exist can't have usage stored, they are rejected by auth anyway
+		var used int64
+		err := db.QueryRow("INSERT INTO key_quotas (key_id, period, period_start, used) "+
+			"SELECT id, $2, $3, $4 FROM api_keys WHERE key_hash = $1 "+
+			"ON CONFLICT (key_id, period, period_start) DO UPDATE SET used = key_quotas.used + EXCLUDED.used RETURNING used",
+			c.keyHash, c.period, c.start, amount).Scan(&used)
+		if err != nil && err != sql.ErrNoRows {
+			logger.WithError(err).Error("Error saving quota usage")
+			continue
+		}
+
+		q.mu.Lock()
+		c.pending -= amount
+		if err == nil {
+			c.used = used
+		} else {
+			c.used += amount
+		}
+		c.loaded = time.Now()
+		q.mu.Unlock()
+	}
+
+	// Counters of past periods are done once they're written
+	q.mu.Lock()
+	now := time.Now().UTC()
+	for id, c := range q.counters {
+		for _, p := range quotaPeriods {
+			if p.name == c.period && !p.end(c.start).After(now) && c.pending == 0 {
+				delete(q.counters, id)
+			}
+		}
+	}
+	q.mu.Unlock()
+}
+
+// Quotas are flushed one last time when ctx is cancelled
+func flushQuotasRoutine(ctx context.Context, db *sql.DB) {
+	for sleepContext(ctx, quotaFlushInterval) {
+		quotas.flush(db)
+	}
+	quotas.flush(db)
+}
+
+func pruneQuotaUsage(db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM key_quotas WHERE period_start < $1", time.Now().Add(-quotaRetention))
+	if err != nil {
+		return fmt.Errorf("error removing old quota usage. %v", err)
+	}
+	return nil
+}
+
+func setQuotaHeaders(c *gin.Context, statuses []quotaStatus) {
+	for _, s := range statuses {
+		prefix := "X-Quota-" + s.Period.header + "-"
+		c.Header(prefix+"Limit", strconv.FormatInt(s.Limit, 10))
+		c.Header(prefix+"Remaining", strconv.FormatInt(s.Remaining, 10))
+		c.Header(prefix+"Reset", strconv.FormatInt(s.Reset.Unix(), 10))
+	}
+}
+
+// quotaReset returns when all exceeded quotas are available again
+func quotaReset(statuses []quotaStatus) time.Time {
+	var reset time.Time
+	for _, s := range statuses {
+		if s.Exceeded && s.Reset.After(reset) {
+			reset = s.Reset
+		}
+	}
+	return reset
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func quotaPeriodByName(name string) quotaPeriod {
+	for _, p := range quotaPeriods {
+		if p.name == name {
+			return p
+		}
+	}
+	panic("unknown quota period " + name)
+}
+
+func TestQuotaPeriods(t *testing.T) {
+	tests := []struct {
+		period string
+		now    time.Time
+		start  time.Time
+		end    time.Time
+	}{
+		{"daily", time.Date(2024, 3, 10, 15, 4, 5, 0, time.UTC), time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)},
+		{"daily", time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)},
+		{"daily", time.Date(2024, 3, 10, 23, 59, 59, 0, time.UTC), time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)},
+		{"daily", time.Date(2024, 2, 29, 12, 0, 0, 0, time.UTC), time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)},
+		{"daily", time.Date(2024, 12, 31, 12, 0, 0, 0, time.UTC), time.Date(2024, 12, 31, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"monthly", time.Date(2024, 3, 10, 15, 4, 5, 0, time.UTC), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)},
+		{"monthly", time.Date(2024, 1, 31, 23, 0, 0, 0, time.UTC), time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"monthly", time.Date(2024, 12, 31, 23, 59, 59, 0, time.UTC), time.Date(2024, 12, 1, 0, 0, 0, 0, time.UTC), time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		p := quotaPeriodByName(tt.period)
+		start := p.start(tt.now)
+		if !start.Equal(tt.start) {
+			t.Errorf("%v at %v: got start %v, want %v", tt.period, tt.now, start, tt.start)
+		}
+		if end := p.end(start); !end.Equal(tt.end) {
+			t.Errorf("%v at %v: got end %v, want %v", tt.period, tt.now, end, tt.end)
+		}
+	}
+}
+
+// newTestQuotas has counters for the current periods in memory, so nothing is loaded from the database
+func newTestQuotas(keyHash string, used int64) *quotaTracker {
+	now := time.Now().UTC()
+	q := &quotaTracker{counters: make(map[string]*quotaCounter)}
+	for _, p := range quotaPeriods {
+		q.counters[keyHash+"/"+p.name] = &quotaCounter{keyHash: keyHash, period: p.name, start: p.start(now), used: used, loaded: now}
+	}
+	return q
+}
+
+func TestQuotaTake(t *testing.T) {
+	tests := []struct {
+		name      string
+		tier      rateTier
+		used      int64
+		cost      int64
+		allowed   bool
+		remaining []int64
+	}{
+		{"unlimited", rateTier{}, 100, 1, true, nil},
+		{"within daily quota", rateTier{DailyQuota: 10}, 3, 2, true, []int64{5}},
+		{"uses up daily quota", rateTier{DailyQuota: 10}, 8, 2, true, []int64{0}},
+		{"over daily quota", rateTier{DailyQuota: 10}, 9, 2, false, []int64{1}},
+		{"both quotas", rateTier{DailyQuota: 10, MonthlyQuota: 100}, 5, 1, true, []int64{4, 94}},
+		{"monthly quota stops it", rateTier{DailyQuota: 1000, MonthlyQuota: 10}, 10, 1, false, []int64{990, 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newTestQuotas("key", tt.used)
+			statuses, allowed := q.take(nil, "key", tt.tier, tt.cost)
+			if allowed != tt.allowed {
+				t.Fatalf("got allowed %v, want %v", allowed, tt.allowed)
+			}
+			if len(statuses) != len(tt.remaining) {
+				t.Fatalf("got %v statuses, want %v", len(statuses), len(tt.remaining))
+			}
+			for i, s := range statuses {
+				if s.Remaining != tt.remaining[i] {
+					t.Errorf("%v: got %v remaining, want %v", s.Period.name, s.Remaining, tt.remaining[i])
+				}
+			}
+
+			// Nothing is charged if it doesn't fit
+			wantPending := int64(0)
+			if allowed {
+				wantPending = tt.cost
+			}
+			for id, c := range q.counters {
+				if c.pending != wantPending {
+					t.Errorf("%v: got %v pending, want %v", id, c.pending, wantPending)
+				}
+			}
+		})
+	}
+}
+
+func TestQuotaRefund(t *testing.T) {
+	tier := rateTier{DailyQuota: 10}
+	q := newTestQuotas("key", 5)
+
+	if _, allowed := q.take(nil, "key", tier, 3); !allowed {
+		t.Fatal("take should fit")
+	}
+	if got := q.peek("key", tier)[0].Remaining; got != 2 {
+		t.Fatalf("got %v remaining after take, want 2", got)
+	}
+
+	q.refund("key", 3)
+	if got := q.peek("key", tier)[0].Remaining; got != 5 {
+		t.Fatalf("got %v remaining after refund, want 5", got)
+	}
+
+	// A refund after the charge was flushed leaves a negative amount for the next flush
+	q.refund("key", 1)
+	if got := q.counters["key/daily"].pending; got != -1 {
+		t.Fatalf("got %v pending, want -1", got)
+	}
+}
+
+func TestQuotaRollover(t *testing.T) {
+	tier := rateTier{DailyQuota: 10, MonthlyQuota: 100}
+	now := time.Now().UTC()
+	daily := quotaPeriodByName("daily")
+
+	// Yesterday's usage doesn't count against today
+	q := newTestQuotas("key", 50)
+	yesterday := daily.start(now).AddDate(0, 0, -1)
+	q.counters["key/daily"] = &quotaCounter{keyHash: "key", period: "daily", start: yesterday, used: 10, pending: 2, loaded: now}
+
+	statuses := q.peek("key", tier)
+	if len(statuses) != 1 || statuses[0].Period.name != "monthly" || statuses[0].Remaining != 50 {
+		t.Fatalf("got %+v, want only the monthly quota", statuses)
+	}
+
+	// Refunds only go to the current period, yesterday's pending usage still gets written
+	q.refund("key", 1)
+	if got := q.counters["key/daily"].pending; got != 2 {
+		t.Fatalf("got %v pending for yesterday, want 2", got)
+	}
+	if got := q.counters["key/monthly"].pending; got != -1 {
+		t.Fatalf("got %v pending for this month, want -1", got)
+	}
+}
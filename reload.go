@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+type handlerBox struct {
+	http.Handler
+}
+
+// reloadableHandler lets a router be replaced while its server keeps running
+type reloadableHandler struct {
+	handler atomic.Value
+}
+
+func newReloadableHandler(h http.Handler) *reloadableHandler {
+	r := &reloadableHandler{}
+	r.set(h)
+	return r
+}
+
+func (r *reloadableHandler) set(h http.Handler) {
+	r.handler.Store(handlerBox{h})
+}
+
+func (r *reloadableHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.handler.Load().(handlerBox).ServeHTTP(w, req)
+}
+
+// Editors can trigger several change events in a row
+var reloadMu sync.Mutex
+
+// restartOnlyChanges lists the settings that differ from the running ones but are only read on startup
+func restartOnlyChanges(running *config, changed *config) []string {
+	var settings []string
+	check := func(name string, before interface{}, after interface{}) {
+		if !reflect.DeepEqual(before, after) {
+			settings = append(settings, name)
+		}
+	}
+
+	check("shutdown_timeout", running.ShutdownTimeout, changed.ShutdownTimeout)
+	check("database", running.Database, changed.Database)
+	check("api", running.APIConfig, changed.APIConfig)
+	check("cache", running.EtcdConfig, changed.EtcdConfig)
+	check("apiserver.address", running.APIServer.Address, changed.APIServer.Address)
+	check("auth.address", running.Auth.Address, changed.Auth.Address)
+	check("prom.address", running.PromServer.Address, changed.PromServer.Address)
+	check("encryption", running.Encryption, changed.Encryption)
+	check("limits.backend", running.Limits.Backend, changed.Limits.Backend)
+	check("reverse_proxy.trusted", running.Proxy.Trusted, changed.Proxy.Trusted)
+	check("log", running.Log, changed.Log)
+	check("tracing", running.Tracing, changed.Tracing)
+
+	return settings
+}
+
+// reloadConfig applies endpoints, origins, cache policies, limits and key settings from the config file
+// The config is validated before anything is built, so a bad config changes nothing
+// Limiters and queues carry over, only their settings change
+// Changes to settings that are only read on startup are logged, see restartOnlyChanges
+func reloadConfig(running *config, db *sql.DB, cache *clientv3.Client, api *reloadableHandler, auth *reloadableHandler) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	// Viper keeps the previous values if the file can't be read, which shouldn't count as a reload
+	if err := viper.ReadInConfig(); err != nil {
+		return fmt.Errorf("error reading config. %v", err)
+	}
+
+	cfg, err := unmarshalConfig()
+	if err != nil {
+		return err
+	}
+	if err = validateConfig(&cfg); err != nil {
+		return err
+	}
+	restartOnly := restartOnlyChanges(running, &cfg)
+	// Token refreshes keep using the credentials from startup, so signups have to as well
+	cfg.APIConfig = running.APIConfig
+
+	apiRoutes, err := apiRouter(db, cache, cfg)
+	if err != nil {
+		return err
+	}
+	authRoutes := authRouter(db, cache, cfg)
+
+	api.set(apiRoutes)
+	auth.set(authRoutes)
+	endpointLimits.prune()
+	upstreamLimit.reconfigure(&cfg.Limits)
+	setKeysConfig(cfg.Keys)
+	if err = setupTiers(db, cfg.Limits.Key); err != nil {
+		// The routers are in place already, the database catches up on the next reload
+		logger.WithError(err).Error("Couldn't apply key limit to the default tier")
+	}
+	if len(restartOnly) > 0 {
+		logger.WithField("settings", restartOnly).Warn("Changed settings only take effect after a restart")
+	}
+
+	return nil
+}
+
+func watchConfig(running *config, db *sql.DB, cache *clientv3.Client, api *reloadableHandler, auth *reloadableHandler) {
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		if err := reloadConfig(running, db, cache, api, auth); err != nil {
+			logger.WithError(err).WithField("file", e.Name).Error("Rejected config change, keeping the previous config")
+			configReloadsFailed.Inc()
+			return
+		}
+		logger.WithField("file", e.Name).Info("Reloaded config")
+		configReloads.Inc()
+	})
+	viper.WatchConfig()
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRestartOnlyChanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *config)
+		want   []string
+	}{
+		{"nothing", func(cfg *config) {}, nil},
+		{"reloadable settings", func(cfg *config) {
+			cfg.APIServer.AllowedOrigins = []string{"https://other.example.com"}
+			cfg.Limits.Key.Rate = 5
+			cfg.Keys.InactivityPeriod = time.Hour
+		}, nil},
+		{"limit backend", func(cfg *config) { cfg.Limits.Backend = "etcd" }, []string{"limits.backend"}},
+		{"trusted proxies", func(cfg *config) { cfg.Proxy.Trusted = []string{"10.0.0.0/8"} }, []string{"reverse_proxy.trusted"}},
+		{"several", func(cfg *config) {
+			cfg.Database.Dsn = "postgres://other/osuproxy"
+			cfg.APIServer.Address = ":9000"
+			cfg.Log.Level = "debug"
+		}, []string{"database", "apiserver.address", "log"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			running := validTestConfig()
+			changed := validTestConfig()
+			tt.change(&changed)
+
+			if got := restartOnlyChanges(&running, &changed); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
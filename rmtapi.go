@@ -1,15 +1,23 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func rmtAPIRequest(url string, token string) (string, error) {
-	fmt.Println("Fetching remote", url)
-	req, err := http.NewRequest("GET", url, nil)
+func rmtAPIRequest(ctx context.Context, url string, token string) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "osu request", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("http.method", "GET"), attribute.String("http.url", url)))
+	defer func() { endSpanWithError(span, err) }()
+
+	logger.WithField("url", url).Debug("Fetching remote")
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
 	if err != nil {
 		return "", fmt.Errorf("couldn't create request. %v", err)
 	}
@@ -20,11 +28,16 @@ func rmtAPIRequest(url string, token string) (string, error) {
 	req.Header.Set("Authorization", "Bearer "+token)
 
 	client := &http.Client{}
+	upstreamRequestsInFlight.Inc()
 	resp, err := client.Do(req)
+	upstreamRequestsInFlight.Dec()
 	if err != nil {
 		return "", fmt.Errorf("couldn't execute request with client. %v", err)
 	}
 	defer resp.Body.Close()
+	span.SetAttributes(attribute.Int("http.status_code", resp.StatusCode))
+
+	upstreamLimit.observe(resp)
 
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
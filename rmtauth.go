@@ -39,7 +39,7 @@ type TokenResult struct {
 	ExpiryTime       time.Time
 }
 
-func osuRequestAuthURL(cfg *osuAPIConfig) (string, error) {
+func osuRequestAuthURL(cfg *osuAPIConfig, state string) (string, error) {
 	base, err := url.Parse("https://osu.ppy.sh/oauth/authorize")
 	if err != nil {
 		return "", err
@@ -50,7 +50,7 @@ func osuRequestAuthURL(cfg *osuAPIConfig) (string, error) {
 	params.Add("redirect_uri", cfg.RedirectURI)
 	params.Add("response_type", "code")
 	params.Add("scope", "public")
-	params.Add("state", "")
+	params.Add("state", state)
 
 	base.RawQuery = params.Encode()
 
@@ -141,3 +141,27 @@ func refreshToken(cfg *osuAPIConfig, token string) (*TokenResult, error) {
 
 	return getTokenImpl(refreshPost)
 }
+
+// revokeToken invalidates an access token and its refresh token with osu
+func revokeToken(token string) error {
+	req, err := http.NewRequest("DELETE", "https://osu.ppy.sh/api/v2/oauth/tokens/current", nil)
+	if err != nil {
+		return fmt.Errorf("couldn't create request. %v", err)
+	}
+
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("couldn't execute request with client. %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status revoking token. %v", resp.Status)
+	}
+
+	return nil
+}
@@ -4,14 +4,15 @@ import (
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"golang.org/x/time/rate"
 )
 
 type rmtHandler struct {
 	name        string
 	lclEndpoint string
 	rmtURL      func(c *gin.Context) string
-	rmtLimit    *rate.Limit
+	rmtLimit    *limitConfig
+	// The first parameter identifies a user whose cached data is purged on account deletion
+	userSpecific bool
 }
 
 var (
@@ -29,6 +30,7 @@ var (
 			rmtURL: func(c *gin.Context) string {
 				return "/api/v2/users/" + c.Param("user") + "/" + c.Param("mode")
 			},
+			userSpecific: true,
 		},
 		{
 			name:        "scorefile",
@@ -36,7 +38,7 @@ var (
 			rmtURL: func(c *gin.Context) string {
 				return "/api/v2/scores/" + c.Param("mode") + "/" + c.Param("score") + "/download"
 			},
-			rmtLimit: &[]rate.Limit{rate.Every(6 * time.Second)}[0], // Hack to get a pointer
+			rmtLimit: &limitConfig{Interval: 6 * time.Second, Burst: 1},
 		},
 		{
 			name:        "beatmaps_lookup_checksum",
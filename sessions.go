@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	sessionCookie   = "osuproxy_session"
+	sessionDuration = 7 * 24 * time.Hour
+)
+
+type session struct {
+	userID    int64
+	csrfToken string
+}
+
+// Session ids are stored hashed just like api keys
+func createSession(db *sql.DB, userID int64) (string, error) {
+	id, err := randomString(64)
+	if err != nil {
+		return "", fmt.Errorf("error generating session id. %v", err)
+	}
+	csrfToken, err := randomString(64)
+	if err != nil {
+		return "", fmt.Errorf("error generating csrf token. %v", err)
+	}
+
+	_, err = db.Exec("DELETE FROM sessions WHERE expires_at < now()")
+	if err != nil {
+		return "", fmt.Errorf("error removing expired sessions. %v", err)
+	}
+
+	_, err = db.Exec("INSERT INTO sessions (id_hash,user_id,csrf_token,expires_at) VALUES($1,$2,$3,$4)",
+		hashKey(id), userID, csrfToken, time.Now().Add(sessionDuration))
+	if err != nil {
+		return "", fmt.Errorf("error saving session. %v", err)
+	}
+
+	return id, nil
+}
+
+func lookupSession(db *sql.DB, id string) (*session, error) {
+	var s session
+	err := db.QueryRow("SELECT user_id, csrf_token FROM sessions WHERE id_hash = $1 AND expires_at > now()", hashKey(id)).Scan(&s.userID, &s.csrfToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s, nil
+}
+
+func deleteSession(db *sql.DB, id string) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE id_hash = $1", hashKey(id))
+	return err
+}
+
+// setCookie only marks cookies secure if the site is served over https
+func setCookie(c *gin.Context, cfg *config, name string, value string, maxAge int) {
+	secure := false
+	if u, err := url.Parse(cfg.APIConfig.RedirectURI); err == nil {
+		secure = u.Scheme == "https"
+	}
+
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(name, value, maxAge, "/", "", secure, true)
+}
+
+func setSessionCookie(c *gin.Context, cfg *config, id string, maxAge int) {
+	setCookie(c, cfg, sessionCookie, id, maxAge)
+}
+
+// requireSession redirects to the main page unless the user is logged in
+func requireSession(db *sql.DB) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, err := c.Cookie(sessionCookie)
+		if err != nil || id == "" {
+			c.Redirect(http.StatusSeeOther, "/")
+			c.Abort()
+			return
+		}
+
+		s, err := lookupSession(db, id)
+		if err != nil {
+			if err != sql.ErrNoRows {
+				requestLog(c).WithError(err).Error("Error looking up session")
+			}
+			c.Redirect(http.StatusSeeOther, "/")
+			c.Abort()
+			return
+		}
+
+		c.Set("sessionID", id)
+		c.Set("session", s)
+		c.Set("userID", s.userID)
+		c.Next()
+	}
+}
+
+// requireCSRF checks the token embedded in dashboard forms
+func requireCSRF() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s := c.MustGet("session").(*session)
+
+		if subtle.ConstantTimeCompare([]byte(c.PostForm("csrf_token")), []byte(s.csrfToken)) != 1 {
+			c.String(http.StatusForbidden, "Invalid form token")
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
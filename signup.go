@@ -1,12 +1,20 @@
 package main
 
 import (
+	"crypto/subtle"
 	"database/sql"
 	"fmt"
 	"net/http"
-	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/sirupsen/logrus"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	oauthStateCookie   = "osuproxy_oauth_state"
+	oauthStateDuration = 10 * time.Minute
 )
 
 func disabledSignupsHandler(c *gin.Context) {
@@ -22,7 +30,7 @@ func authFunc(db *sql.DB, cfg config) gin.HandlerFunc {
 	}
 
 	handleError := func(c *gin.Context, err string) {
-		fmt.Println(err)
+		requestLog(c).Error(err)
 		c.HTML(200, "error.tmpl", gin.H{
 			"Error": err,
 		})
@@ -30,8 +38,15 @@ func authFunc(db *sql.DB, cfg config) gin.HandlerFunc {
 	}
 
 	return func(c *gin.Context) {
+		// The state has to match the one handed to this browser, otherwise anyone could log it into their account
+		state, err := c.Cookie(oauthStateCookie)
+		setCookie(c, &cfg, oauthStateCookie, "", -1)
+		if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(c.Query("state")), []byte(state)) != 1 {
+			handleError(c, "signup state doesn't match, please try signing in again")
+			return
+		}
+
 		code := c.Query("code")
-		// code := r.URL.Query()["state"]	// TODO but not high priority as afaik the worst thing that can happen is that an attacker can share their api key?
 		if len(code) == 0 {
 			handleError(c, "got no code for signup")
 			return
@@ -56,67 +71,116 @@ func authFunc(db *sql.DB, cfg config) gin.HandlerFunc {
 
 		exists, err := userExists(user.ID, db)
 		if err != nil {
-			fmt.Println(err)
 			handleError(c, fmt.Sprintf("error checking user existence: %v", err))
 			return
 		}
-		fmt.Printf("user %s (%d) - exists: %t\n", user.Username, user.ID, exists)
+		c.Set("userID", user.ID)
+		requestLog(c).WithFields(logrus.Fields{"username": user.Username, "exists": exists}).Info("Signing in user")
 
-		var key string
+		var (
+			key     string
+			oldKeys []apiKey
+		)
 		if exists {
-			fmt.Printf("user %s (%d) - Updating tokens...\n", user.Username, user.ID)
+			requestLog(c).Info("Updating tokens")
 			err = updateTokens(db, token.ExpiryTime, token.AccessToken, token.RefreshToken, user.ID)
 			if err != nil {
 				handleError(c, fmt.Sprintf("user %s (%d) - failed to update token: %v", user.Username, user.ID, err))
 				return
 			}
 
-			key, err = userKey(user.ID, db)
+			// Keys are only stored hashed, so we can only tell which ones are in use
+			oldKeys, err = listKeys(db, user.ID)
 			if err != nil {
-				handleError(c, fmt.Sprintf("user %s (%d) - failed to retrieve api key: %v", user.Username, user.ID, err))
+				handleError(c, fmt.Sprintf("user %s (%d) - failed to retrieve api keys: %v", user.Username, user.ID, err))
 				return
 			}
+
+			// Without any keys left there would be no way to use the proxy
+			if len(oldKeys) == 0 {
+				key, _, err = createKey(db, user.ID, defaultKeyLabel, nil)
+				if err != nil {
+					handleError(c, fmt.Sprintf("user %s (%d) - failed to generate api key: %v", user.Username, user.ID, err))
+					return
+				}
+			}
 			tokensRefreshed.Inc()
 		} else {
-			fmt.Printf("user %s (%d) - Generating key...\n", user.Username, user.ID)
-			key, err = uniqueKey(db)
+			requestLog(c).Info("Generating key")
+			accessToken, refreshToken, err := encryptTokens(token.AccessToken, token.RefreshToken)
 			if err != nil {
-				handleError(c, fmt.Sprintf("user %s (%d) - failed to generate api key: %v", user.Username, user.ID, err))
+				handleError(c, fmt.Sprintf("user %s (%d) - failed to encrypt tokens: %v", user.Username, user.ID, err))
 				return
 			}
 
-			stmt, err := db.Prepare("INSERT INTO api_tokens (id,api_key,expiryTime,accessToken,refreshToken) VALUES($1,$2,$3,$4,$5)")
+			stmt, err := db.Prepare("INSERT INTO api_tokens (id,expiryTime,accessToken,refreshToken,nextRefresh) VALUES($1,$2,$3,$4,$5)")
 			if err != nil {
 				handleError(c, fmt.Sprintf("user %s (%d) - failed to prepare database save statement: %v", user.Username, user.ID, err))
 				return
 			}
 			defer stmt.Close()
 
-			_, err = stmt.Exec(user.ID, key, token.ExpiryTime, token.AccessToken, token.RefreshToken)
+			_, err = stmt.Exec(user.ID, token.ExpiryTime, accessToken, refreshToken, nextRefreshTime(token.ExpiryTime))
 			if err != nil {
 				handleError(c, fmt.Sprintf("user %s (%d) - failed to execute database save: %v", user.Username, user.ID, err))
 				return
 			}
+
+			key, _, err = createKey(db, user.ID, defaultKeyLabel, nil)
+			if err != nil {
+				handleError(c, fmt.Sprintf("user %s (%d) - failed to generate api key: %v", user.Username, user.ID, err))
+				return
+			}
 			usersRegistered.Inc()
 		}
 
+		sessionID, err := createSession(db, user.ID)
+		if err != nil {
+			// Signing up worked, so the key should still be shown
+			requestLog(c).WithError(err).Error("Failed to create session")
+		} else {
+			setSessionCookie(c, &cfg, sessionID, int(sessionDuration.Seconds()))
+		}
+
 		c.HTML(http.StatusOK, "authorize.tmpl", gin.H{
 			"Username":  user.Username,
 			"Key":       key,
+			"OldKeys":   oldKeys,
 			"AppKeyURL": cfg.App.AppKeyURL,
 		})
 	}
 }
 
-func mainPageFunc(cfg *config) gin.HandlerFunc {
-	url, err := osuRequestAuthURL(&cfg.APIConfig)
-	if err != nil {
-		panic("Couldn't create auth url")
+// loginFunc sends the user to osu! with a fresh state that authFunc checks against the cookie
+func loginFunc(cfg *config) gin.HandlerFunc {
+	if !cfg.Auth.EnableAuth {
+		return disabledSignupsHandler
 	}
 
+	return func(c *gin.Context) {
+		state, err := randomString(32)
+		if err != nil {
+			requestLog(c).WithError(err).Error("Error generating oauth state")
+			c.String(http.StatusInternalServerError, "Internal server error")
+			return
+		}
+
+		url, err := osuRequestAuthURL(&cfg.APIConfig, state)
+		if err != nil {
+			requestLog(c).WithError(err).Error("Error creating auth url")
+			c.String(http.StatusInternalServerError, "Internal server error")
+			return
+		}
+
+		setCookie(c, cfg, oauthStateCookie, state, int(oauthStateDuration.Seconds()))
+		c.Redirect(http.StatusFound, url)
+	}
+}
+
+func mainPageFunc(cfg *config) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.HTML(http.StatusOK, "index.tmpl", gin.H{
-			"OsuAuthURL":  url,
+			"OsuAuthURL":  "/login",
 			"EnableAuth":  cfg.Auth.EnableAuth,
 			"BuildCommit": BuildCommit,
 			"BuildTime":   BuildTime,
@@ -124,14 +188,23 @@ func mainPageFunc(cfg *config) gin.HandlerFunc {
 	}
 }
 
-func authServer(db *sql.DB, cfg config, wg *sync.WaitGroup) {
-	router := gin.Default()
+func authRouter(db *sql.DB, cache *clientv3.Client, cfg config) http.Handler {
+	router := gin.New()
+	router.Use(gin.Recovery(), requestLogger(), apiTracing())
 	router.LoadHTMLGlob("html/templates/*")
 
 	router.Static("/css/", "html/css")
-	router.GET("/authorize", apiLimitAuth(), authFunc(db, cfg))
+	router.GET("/login", apiLimitAuth(cfg.Limits.Auth), loginFunc(&cfg))
+	router.GET("/authorize", apiLimitAuth(cfg.Limits.Auth), authFunc(db, cfg))
 	router.GET("/", mainPageFunc(&cfg))
 
-	router.Run(cfg.Auth.Address)
-	wg.Done()
+	dashboard := router.Group("/", requireSession(db))
+	dashboard.GET("/dashboard", dashboardFunc(db, &cfg))
+	dashboard.POST("/dashboard/keys", requireCSRF(), dashboardCreateKeyFunc(db, &cfg))
+	dashboard.POST("/dashboard/keys/:id/regenerate", requireCSRF(), dashboardRegenerateKeyFunc(db, &cfg))
+	dashboard.POST("/dashboard/keys/:id/revoke", requireCSRF(), dashboardRevokeKeyFunc(db, &cfg))
+	dashboard.POST("/dashboard/delete", requireCSRF(), dashboardDeleteAccountFunc(db, cache, &cfg))
+	dashboard.POST("/logout", requireCSRF(), logoutFunc(db, &cfg))
+
+	return router
 }
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestLoginState(t *testing.T) {
+	cfg := validTestConfig()
+	cfg.Auth.EnableAuth = true
+
+	router := gin.New()
+	router.LoadHTMLGlob("html/templates/*")
+	router.GET("/login", loginFunc(&cfg))
+	// No database is needed as long as the state is rejected before the code is used
+	router.GET("/authorize", authFunc(nil, cfg))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("got status %v, want a redirect", w.Code)
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := location.Query().Get("state")
+	if state == "" {
+		t.Fatalf("redirect %v has no state", location)
+	}
+
+	var cookie *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == oauthStateCookie {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value != state || !cookie.HttpOnly {
+		t.Fatalf("got state cookie %v, want an http only cookie with %q", cookie, state)
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		cookie string
+	}{
+		{"no cookie", "?code=abc&state=" + state, ""},
+		{"no state", "?code=abc", state},
+		{"other state", "?code=abc&state=other", state},
+		{"empty state", "?code=abc&state=", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/authorize"+tt.query, nil)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: oauthStateCookie, Value: tt.cookie})
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if !strings.Contains(w.Body.String(), "try signing in again") {
+				t.Fatalf("got %q, want the state to be rejected", w.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultTier = "default"
+	// Tier changes in the database apply to running servers after this long
+	tierCacheDuration = time.Minute
+)
+
+type rateTier struct {
+	Name  string
+	Rate  rate.Limit
+	Burst int
+	// Quotas of 0 mean unlimited
+	DailyQuota   int64
+	MonthlyQuota int64
+	loaded       time.Time
+}
+
+type tierCache struct {
+	keys map[string]*rateTier
+	mu   sync.Mutex
+}
+
+var keyTiers = &tierCache{keys: make(map[string]*rateTier)}
+
+// Used when the database can't be reached
+var fallbackTier = rateTier{Name: defaultTier, Rate: 2, Burst: 3}
+
+// setupTiers makes the configured key limit the rate and burst of the default tier
+// Quotas of the default tier and all other tiers are managed with set-tier
+func setupTiers(db *sql.DB, cfg limitConfig) error {
+	keyTiers.mu.Lock()
+	fallbackTier = rateTier{Name: defaultTier, Rate: cfg.limit(), Burst: cfg.Burst}
+	// Keys on the default tier pick up the change right away
+	keyTiers.keys = make(map[string]*rateTier)
+	keyTiers.mu.Unlock()
+
+	_, err := db.Exec("UPDATE rate_tiers SET rate = $1, burst = $2 WHERE name = $3", float64(cfg.limit()), cfg.Burst, defaultTier)
+	if err != nil {
+		return fmt.Errorf("error updating default tier. %v", err)
+	}
+
+	return nil
+}
+
+func loadKeyTier(db *sql.DB, keyHash string) (*rateTier, error) {
+	t := rateTier{loaded: time.Now()}
+	var r float64
+	err := db.QueryRow("SELECT t.name, t.rate, t.burst, t.daily_quota, t.monthly_quota FROM api_keys k JOIN rate_tiers t ON t.name = k.tier WHERE k.key_hash = $1", keyHash).
+		Scan(&t.Name, &r, &t.Burst, &t.DailyQuota, &t.MonthlyQuota)
+	if err == sql.ErrNoRows {
+		// The key was revoked since it was authenticated
+		err = db.QueryRow("SELECT name, rate, burst, daily_quota, monthly_quota FROM rate_tiers WHERE name = $1", defaultTier).
+			Scan(&t.Name, &r, &t.Burst, &t.DailyQuota, &t.MonthlyQuota)
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.Rate = rate.Limit(r)
+
+	return &t, nil
+}
+
+// get returns the tier of a key, which is reloaded from the database once it's stale
+func (tc *tierCache) get(db *sql.DB, keyHash string) rateTier {
+	tc.mu.Lock()
+	t, exists := tc.keys[keyHash]
+	tc.mu.Unlock()
+
+	if exists && time.Since(t.loaded) < tierCacheDuration {
+		return *t
+	}
+
+	loaded, err := loadKeyTier(db, keyHash)
+	if err != nil {
+		logger.WithError(err).Error("Error loading rate tier")
+		if exists {
+			return *t
+		}
+		tc.mu.Lock()
+		defer tc.mu.Unlock()
+		return fallbackTier
+	}
+
+	tc.mu.Lock()
+	tc.keys[keyHash] = loaded
+	tc.mu.Unlock()
+
+	return *loaded
+}
+
+// cached returns the tier of a key that was used recently, without going to the database
+func (tc *tierCache) cached(keyHash string) (rateTier, bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	t, exists := tc.keys[keyHash]
+	if !exists {
+		return rateTier{}, false
+	}
+	return *t, true
+}
+
+func (tc *tierCache) cleanup() {
+	tc.mu.Lock()
+	for key, t := range tc.keys {
+		if time.Since(t.loaded) > tierCacheDuration {
+			delete(tc.keys, key)
+		}
+	}
+	tc.mu.Unlock()
+}
+
+func listTiers(db *sql.DB) ([]rateTier, error) {
+	rows, err := db.Query("SELECT name, rate, burst, daily_quota, monthly_quota FROM rate_tiers ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("error querying database. %v", err)
+	}
+	defer rows.Close()
+
+	var tiers []rateTier
+	for rows.Next() {
+		var (
+			t rateTier
+			r float64
+		)
+		if err = rows.Scan(&t.Name, &r, &t.Burst, &t.DailyQuota, &t.MonthlyQuota); err != nil {
+			return nil, fmt.Errorf("couldn't scan tier %v", err)
+		}
+		t.Rate = rate.Limit(r)
+		tiers = append(tiers, t)
+	}
+
+	return tiers, rows.Err()
+}
+
+func saveTier(db *sql.DB, t rateTier) error {
+	if t.Rate <= 0 || t.Burst <= 0 || t.DailyQuota < 0 || t.MonthlyQuota < 0 {
+		return fmt.Errorf("rate and burst have to be positive and quotas can't be negative")
+	}
+
+	_, err := db.Exec("INSERT INTO rate_tiers (name, rate, burst, daily_quota, monthly_quota) VALUES($1,$2,$3,$4,$5) "+
+		"ON CONFLICT (name) DO UPDATE SET rate = $2, burst = $3, daily_quota = $4, monthly_quota = $5",
+		t.Name, float64(t.Rate), t.Burst, t.DailyQuota, t.MonthlyQuota)
+	if err != nil {
+		return fmt.Errorf("error saving tier. %v", err)
+	}
+
+	return nil
+}
+
+func setKeyTier(db queryer, keyID int64, tier string) error {
+	res, err := db.Exec("UPDATE api_keys SET tier = $1 WHERE id = $2", tier, keyID)
+	if err != nil {
+		return fmt.Errorf("error setting tier. %v", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error setting tier. %v", err)
+	}
+	if n == 0 {
+		return fmt.Errorf("no such key")
+	}
+
+	return nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// How long before expiry a token gets refreshed
+	tokenRefreshMargin = time.Hour
+	// Upper bound for sleeping between checks so new signups are noticed
+	tokenRefreshMaxSleep = 10 * time.Minute
+	// Retry delays after failures grow from the base up to the maximum
+	tokenRefreshBaseBackoff = 5 * time.Minute
+	tokenRefreshMaxBackoff  = 6 * time.Hour
+)
+
+type pendingRefresh struct {
+	id           int64
+	refreshToken string
+	failures     int
+}
+
+// Refreshed tokens that couldn't be saved, osu! already threw away the refresh token we have stored for these users
+var unsavedTokens = struct {
+	sync.Mutex
+	tokens map[int64]*TokenResult
+}{tokens: make(map[int64]*TokenResult)}
+
+func keepUnsavedToken(id int64, token *TokenResult) {
+	unsavedTokens.Lock()
+	defer unsavedTokens.Unlock()
+	unsavedTokens.tokens[id] = token
+}
+
+func takeUnsavedToken(id int64) *TokenResult {
+	unsavedTokens.Lock()
+	defer unsavedTokens.Unlock()
+	token := unsavedTokens.tokens[id]
+	delete(unsavedTokens.tokens, id)
+	return token
+}
+
+func nextRefreshTime(expiryTime time.Time) time.Time {
+	return expiryTime.Add(-tokenRefreshMargin)
+}
+
+func refreshBackoff(failures int) time.Duration {
+	backoff := tokenRefreshBaseBackoff
+	for i := 1; i < failures && backoff < tokenRefreshMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > tokenRefreshMaxBackoff {
+		backoff = tokenRefreshMaxBackoff
+	}
+	return backoff
+}
+
+func dueRefreshes(db *sql.DB) ([]pendingRefresh, error) {
+	rows, err := db.Query("SELECT id, refreshToken, refreshFailures FROM api_tokens WHERE NOT revoked AND NOT dormant AND nextRefresh <= $1 ORDER BY nextRefresh", time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("error querying database. %v", err)
+	}
+	defer rows.Close()
+
+	var due, undecryptable []pendingRefresh
+	var decryptErrs []error
+	for rows.Next() {
+		var p pendingRefresh
+		if err = rows.Scan(&p.id, &p.refreshToken, &p.failures); err != nil {
+			return due, fmt.Errorf("couldn't scan token %v", err)
+		}
+		if p.refreshToken, err = tokenCrypt.decrypt(p.refreshToken); err != nil {
+			undecryptable = append(undecryptable, p)
+			decryptErrs = append(decryptErrs, fmt.Errorf("couldn't decrypt token. %v", err))
+			continue
+		}
+		due = append(due, p)
+	}
+	if err = rows.Err(); err != nil {
+		return due, err
+	}
+	rows.Close()
+
+	// One bad row shouldn't hold up everyone else, it gets backed off like any other failed refresh
+	for i, p := range undecryptable {
+		tokenRefreshFailed.Inc()
+		logger.WithError(decryptErrs[i]).WithField("user_id", p.id).Warn("Error refreshing token")
+		if err = recordRefreshFailure(db, p, decryptErrs[i], false); err != nil {
+			logger.WithError(err).WithField("user_id", p.id).Error("Error recording token refresh failure")
+		}
+	}
+
+	return due, nil
+}
+
+func recordRefreshFailure(db *sql.DB, p pendingRefresh, refreshErr error, revoked bool) error {
+	failures := p.failures + 1
+	nextRefresh := time.Now().Add(refreshBackoff(failures))
+
+	_, err := db.Exec("UPDATE api_tokens SET refreshFailures=$1,lastRefreshError=$2,nextRefresh=$3,revoked=$4 WHERE id=$5",
+		failures, refreshErr.Error(), nextRefresh, revoked, p.id)
+	return err
+}
+
+func refreshUserToken(db *sql.DB, cfg *osuAPIConfig, p pendingRefresh) error {
+	// Saving the last refresh failed, so try that again instead of using the stored refresh token
+	if token := takeUnsavedToken(p.id); token != nil {
+		return saveRefreshedToken(db, p, token)
+	}
+
+	token, err := refreshToken(cfg, p.refreshToken)
+	if err != nil {
+		tokenRefreshFailed.Inc()
+
+		// The user revoked our access, so retrying is pointless until they sign up again
+		revoked := token != nil && token.Error == "invalid_grant"
+		if revoked {
+			tokensRevoked.Inc()
+		}
+
+		if dbErr := recordRefreshFailure(db, p, err, revoked); dbErr != nil {
+			return fmt.Errorf("error refreshing token. %v, additionally failed to record failure. %v", err, dbErr)
+		}
+		return fmt.Errorf("error refreshing token. %v", err)
+	}
+
+	return saveRefreshedToken(db, p, token)
+}
+
+func saveRefreshedToken(db *sql.DB, p pendingRefresh, token *TokenResult) error {
+	err := updateTokens(db, token.ExpiryTime, token.AccessToken, token.RefreshToken, p.id)
+	if err != nil {
+		tokenRefreshFailed.Inc()
+		keepUnsavedToken(p.id, token)
+
+		if dbErr := recordRefreshFailure(db, p, err, false); dbErr != nil {
+			return fmt.Errorf("error saving refreshed token. %v, additionally failed to record failure. %v", err, dbErr)
+		}
+		return fmt.Errorf("error saving refreshed token. %v", err)
+	}
+
+	tokenRefreshSuccess.Inc()
+	return nil
+}
+
+func refreshDueTokens(ctx context.Context, db *sql.DB, cfg *osuAPIConfig) {
+	due, err := dueRefreshes(db)
+	if err != nil {
+		logger.WithError(err).Error("Error getting tokens to refresh")
+		return
+	}
+
+	if len(due) > 0 {
+		logger.WithField("count", len(due)).Info("Refreshing tokens")
+	}
+
+	for i, p := range due {
+		if i > 0 && !sleepContext(ctx, time.Second) {
+			return
+		}
+
+		if err := refreshUserToken(db, cfg, p); err != nil {
+			logger.WithError(err).WithField("user_id", p.id).Warn("Error refreshing token")
+		}
+	}
+}
+
+func timeUntilNextRefresh(db *sql.DB) time.Duration {
+	var next sql.NullTime
+	err := db.QueryRow("SELECT MIN(nextRefresh) FROM api_tokens WHERE NOT revoked AND NOT dormant").Scan(&next)
+	if err != nil {
+		logger.WithError(err).Error("Error getting next token refresh time")
+		return tokenRefreshMaxSleep
+	}
+	if !next.Valid {
+		return tokenRefreshMaxSleep
+	}
+
+	wait := time.Until(next.Time)
+	if wait < time.Second {
+		return time.Second
+	}
+	if wait > tokenRefreshMaxSleep {
+		return tokenRefreshMaxSleep
+	}
+	return wait
+}
+
+func refreshTokensRoutine(ctx context.Context, db *sql.DB, cfg *osuAPIConfig) {
+	for {
+		refreshDueTokens(ctx, db, cfg)
+		if !sleepContext(ctx, timeUntilNextRefresh(db)) {
+			return
+		}
+	}
+}
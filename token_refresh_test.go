@@ -0,0 +1,172 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestDueRefreshesSkipsUndecryptable(t *testing.T) {
+	db := testDatabase(t)
+
+	const (
+		goodUser   = 900000005
+		brokenUser = 900000006
+	)
+	createTestUser(t, db, goodUser, "")
+	createTestUser(t, db, brokenUser, "")
+	// Encrypted with a key that isn't configured, like after dropping a key too early during a rotation
+	if _, err := db.Exec("UPDATE api_tokens SET refreshToken = $1 WHERE id = $2", encryptedPrefix+"gone:a:b", brokenUser); err != nil {
+		t.Fatal(err)
+	}
+
+	due, err := dueRefreshes(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := make(map[int64]bool)
+	for _, p := range due {
+		found[p.id] = true
+	}
+	if !found[goodUser] {
+		t.Errorf("user %v with a readable token wasn't refreshed", goodUser)
+	}
+	if found[brokenUser] {
+		t.Errorf("user %v with an undecryptable token was returned", brokenUser)
+	}
+
+	var failures int
+	var backedOff bool
+	err = db.QueryRow("SELECT refreshFailures, nextRefresh > now() FROM api_tokens WHERE id = $1", brokenUser).Scan(&failures, &backedOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if failures != 1 || !backedOff {
+		t.Errorf("got %v failures and backed off %v, want 1 failure with a backoff", failures, backedOff)
+	}
+}
+
+func TestRefreshBackoff(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 5 * time.Minute},
+		{1, 5 * time.Minute},
+		{2, 10 * time.Minute},
+		{3, 20 * time.Minute},
+		{7, 320 * time.Minute},
+		{8, 6 * time.Hour},
+		{1000, 6 * time.Hour},
+	}
+
+	for _, tt := range tests {
+		if got := refreshBackoff(tt.failures); got != tt.want {
+			t.Errorf("%v failures: got %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestNextRefreshTime(t *testing.T) {
+	expiry := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	if got, want := nextRefreshTime(expiry), time.Date(2024, 3, 10, 11, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
+
+func TestUnsavedTokens(t *testing.T) {
+	if token := takeUnsavedToken(1); token != nil {
+		t.Fatalf("got %v without keeping a token", token)
+	}
+
+	keepUnsavedToken(1, &TokenResult{RefreshToken: "old"})
+	keepUnsavedToken(1, &TokenResult{RefreshToken: "new"})
+	if token := takeUnsavedToken(1); token == nil || token.RefreshToken != "new" {
+		t.Fatalf("got %v, want the newest token", token)
+	}
+	if token := takeUnsavedToken(1); token != nil {
+		t.Fatalf("got %v, the token should only be handed out once", token)
+	}
+}
+
+func TestRecordRefreshFailure(t *testing.T) {
+	db := testDatabase(t)
+
+	const user = 900000007
+	createTestUser(t, db, user, "")
+
+	tests := []struct {
+		name     string
+		failures int
+		revoked  bool
+	}{
+		{"first failure", 0, false},
+		{"repeated failure", 3, false},
+		{"revoked", 1, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := time.Now()
+			err := recordRefreshFailure(db, pendingRefresh{id: user, failures: tt.failures}, errors.New("failed"), tt.revoked)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				failures    int
+				nextRefresh time.Time
+				revoked     bool
+				lastError   string
+			)
+			err = db.QueryRow("SELECT refreshFailures, nextRefresh, revoked, lastRefreshError FROM api_tokens WHERE id = $1", user).
+				Scan(&failures, &nextRefresh, &revoked, &lastError)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if failures != tt.failures+1 || revoked != tt.revoked || lastError != "failed" {
+				t.Errorf("got %v failures, revoked %v and error %q", failures, revoked, lastError)
+			}
+			wait := nextRefresh.Sub(before)
+			if want := refreshBackoff(tt.failures + 1); wait < want-time.Minute || wait > want+time.Minute {
+				t.Errorf("got next refresh in %v, want about %v", wait, want)
+			}
+		})
+	}
+}
+
+func TestRefreshSavesUnsavedToken(t *testing.T) {
+	db := testDatabase(t)
+
+	const user = 900000008
+	createTestUser(t, db, user, "")
+	if _, err := db.Exec("UPDATE api_tokens SET refreshFailures = 2 WHERE id = $1", user); err != nil {
+		t.Fatal(err)
+	}
+
+	// Refreshing would hit osu! with the spent refresh token, the kept one has to be saved instead
+	keepUnsavedToken(user, &TokenResult{AccessToken: "new access", RefreshToken: "new refresh", ExpiryTime: time.Now().Add(24 * time.Hour)})
+	err := refreshUserToken(db, &osuAPIConfig{}, pendingRefresh{id: user, refreshToken: "spent", failures: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		refreshToken string
+		failures     int
+	)
+	if err = db.QueryRow("SELECT refreshToken, refreshFailures FROM api_tokens WHERE id = $1", user).Scan(&refreshToken, &failures); err != nil {
+		t.Fatal(err)
+	}
+	if refreshToken, err = tokenCrypt.decrypt(refreshToken); err != nil {
+		t.Fatal(err)
+	}
+	if refreshToken != "new refresh" || failures != 0 {
+		t.Fatalf("got refresh token %q with %v failures, want the kept token saved", refreshToken, failures)
+	}
+	if token := takeUnsavedToken(user); token != nil {
+		t.Fatalf("the token is still kept after saving it")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// Never go below this fraction of the configured remote limit
+	adaptiveMinFraction = 0.05
+	// Once osu! has less than this fraction of its budget left, slow down
+	adaptiveLowRemaining = 0.1
+	// How often and by how much the limit may grow back towards the configured one
+	adaptiveRecoverInterval = 10 * time.Second
+	adaptiveRecoverFraction = 0.1
+	// osu! reports its limits per minute
+	upstreamLimitWindow = time.Minute
+)
+
+// adaptiveLimit adjusts the global remote limiter to what osu! tells us
+type adaptiveLimit struct {
+	limiter    *rate.Limiter
+	enabled    bool
+	configured rate.Limit
+
+	mu sync.Mutex
+	// The configured limit, lowered to what osu! allows if it reports less
+	ceiling     rate.Limit
+	lastChanged time.Time
+	// Requests sent together get their 429s together, which should only count once
+	lastRateLimited time.Time
+}
+
+var upstreamLimit *adaptiveLimit
+
+func setupUpstreamLimit(cfg *limitsConfig) {
+	limiter := cfg.Remote.newLimiter()
+	upstreamLimit = &adaptiveLimit{
+		limiter:    limiter,
+		enabled:    cfg.AdaptRemote,
+		configured: limiter.Limit(),
+		ceiling:    limiter.Limit(),
+	}
+	upstreamEffectiveLimit.Set(float64(limiter.Limit()))
+}
+
+// reconfigure applies a changed remote limit without forgetting what osu! told us so far
+func (a *adaptiveLimit) reconfigure(cfg *limitsConfig) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	configured := cfg.Remote.limit()
+	if configured == a.configured && cfg.Remote.Burst == a.limiter.Burst() && cfg.AdaptRemote == a.enabled {
+		return
+	}
+
+	now := time.Now()
+	a.limiter.SetBurstAt(now, cfg.Remote.Burst)
+	a.enabled = cfg.AdaptRemote
+	if !a.enabled {
+		a.configured, a.ceiling = configured, configured
+		if a.limiter.Limit() != configured {
+			a.limiter.SetLimitAt(now, configured)
+			upstreamEffectiveLimit.Set(float64(configured))
+		}
+		return
+	}
+
+	// A ceiling below the configured limit was reported by osu! and still applies
+	if a.ceiling >= a.configured || configured < a.ceiling {
+		a.ceiling = configured
+	}
+	a.configured = configured
+	if a.limiter.Limit() > a.ceiling {
+		a.set(a.ceiling, now)
+	}
+}
+
+func (a *adaptiveLimit) minimum() rate.Limit {
+	return a.ceiling * adaptiveMinFraction
+}
+
+func (a *adaptiveLimit) set(limit rate.Limit, now time.Time) {
+	if limit < a.minimum() {
+		limit = a.minimum()
+	}
+	if limit > a.ceiling {
+		limit = a.ceiling
+	}
+	if limit == a.limiter.Limit() {
+		return
+	}
+
+	a.limiter.SetLimitAt(now, limit)
+	a.lastChanged = now
+	upstreamEffectiveLimit.Set(float64(limit))
+}
+
+// observe looks at an upstream response, backing off on 429s and when the budget runs low,
+// and otherwise slowly recovering towards the configured limit
+func (a *adaptiveLimit) observe(resp *http.Response) {
+	if a == nil || !a.enabled {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	current := a.limiter.Limit()
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		if now.Sub(a.lastRateLimited) >= adaptiveRecoverInterval {
+			logger.WithField("limit", float64(current)).Warn("Rate limited by osu!, lowering remote limit")
+			a.set(current/2, now)
+			a.lastRateLimited = now
+		}
+		return
+	}
+
+	limit, errLimit := strconv.ParseFloat(resp.Header.Get("X-RateLimit-Limit"), 64)
+	remaining, errRemaining := strconv.ParseFloat(resp.Header.Get("X-RateLimit-Remaining"), 64)
+	if errLimit == nil && limit > 0 {
+		a.ceiling = a.configured
+		if allowed := rate.Limit(limit / upstreamLimitWindow.Seconds()); allowed < a.ceiling {
+			a.ceiling = allowed
+		}
+
+		if errRemaining == nil && remaining < limit*adaptiveLowRemaining {
+			// Only back off once per interval, every response looks low while the budget is used up
+			if now.Sub(a.lastChanged) >= adaptiveRecoverInterval {
+				a.set(current*0.75, now)
+			}
+			return
+		}
+	}
+
+	if current < a.ceiling && now.Sub(a.lastChanged) >= adaptiveRecoverInterval {
+		a.set(current+a.ceiling*adaptiveRecoverFraction, now)
+	} else if current > a.ceiling {
+		a.set(a.ceiling, now)
+	}
+}
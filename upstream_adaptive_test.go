@@ -0,0 +1,152 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func newTestAdaptiveLimit(configured rate.Limit) *adaptiveLimit {
+	return &adaptiveLimit{
+		limiter:    rate.NewLimiter(configured, 10),
+		enabled:    true,
+		configured: configured,
+		ceiling:    configured,
+	}
+}
+
+// advance pretends d has passed since the limit last changed
+func (a *adaptiveLimit) advance(d time.Duration) {
+	a.lastChanged = a.lastChanged.Add(-d)
+	a.lastRateLimited = a.lastRateLimited.Add(-d)
+}
+
+func upstreamResponse(status int, headers map[string]string) *http.Response {
+	resp := &http.Response{StatusCode: status, Header: make(http.Header)}
+	for k, v := range headers {
+		resp.Header.Set(k, v)
+	}
+	return resp
+}
+
+func rateLimited() *http.Response {
+	return upstreamResponse(http.StatusTooManyRequests, map[string]string{"Retry-After": "5"})
+}
+
+func budget(limit, remaining int) *http.Response {
+	return upstreamResponse(http.StatusOK, map[string]string{
+		"X-RateLimit-Limit":     strconv.Itoa(limit),
+		"X-RateLimit-Remaining": strconv.Itoa(remaining),
+	})
+}
+
+type adaptiveStep struct {
+	after time.Duration
+	resp  *http.Response
+}
+
+func TestAdaptiveLimitObserve(t *testing.T) {
+	ok := upstreamResponse(http.StatusOK, nil)
+
+	tests := []struct {
+		name        string
+		start       rate.Limit
+		disabled    bool
+		steps       []adaptiveStep
+		wantLimit   rate.Limit
+		wantCeiling rate.Limit
+	}{
+		{"429 halves the limit", 10, false, []adaptiveStep{{0, rateLimited()}}, 5, 10},
+		{"burst of 429s backs off once", 10, false, []adaptiveStep{
+			{0, rateLimited()}, {0, rateLimited()}, {time.Second, rateLimited()}, {0, rateLimited()},
+		}, 5, 10},
+		{"429s after the interval back off again", 10, false, []adaptiveStep{
+			{0, rateLimited()}, {adaptiveRecoverInterval, rateLimited()},
+		}, 2.5, 10},
+		{"never below the minimum", 0.6, false, []adaptiveStep{{0, rateLimited()}}, 0.5, 10},
+		{"low budget slows down", 10, false, []adaptiveStep{{adaptiveRecoverInterval, budget(1200, 50)}}, 7.5, 10},
+		{"low budget slows down once per interval", 10, false, []adaptiveStep{
+			{adaptiveRecoverInterval, budget(1200, 50)}, {time.Second, budget(1200, 40)},
+		}, 7.5, 10},
+		{"reported limit lowers the ceiling", 10, false, []adaptiveStep{{0, budget(300, 200)}}, 5, 5},
+		{"higher reported limit keeps the configured one", 10, false, []adaptiveStep{{0, budget(1200, 1000)}}, 10, 10},
+		{"no recovery within the interval", 5, false, []adaptiveStep{{0, ok}, {time.Second, ok}}, 5, 10},
+		{"gradual recovery", 5, false, []adaptiveStep{
+			{adaptiveRecoverInterval, ok}, {time.Second, ok}, {adaptiveRecoverInterval, ok},
+		}, 7, 10},
+		{"recovery stops at the ceiling", 9.5, false, []adaptiveStep{{adaptiveRecoverInterval, ok}}, 10, 10},
+		{"recovery stops at the reported ceiling", 4, false, []adaptiveStep{
+			{0, budget(300, 200)}, {adaptiveRecoverInterval, ok}, {adaptiveRecoverInterval, ok},
+		}, 5, 5},
+		{"disabled ignores osu!", 10, true, []adaptiveStep{{0, rateLimited()}, {0, budget(300, 0)}}, 10, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAdaptiveLimit(10)
+			a.enabled = !tt.disabled
+			a.limiter.SetLimit(tt.start)
+			a.lastChanged = time.Now()
+
+			for _, step := range tt.steps {
+				a.advance(step.after)
+				a.observe(step.resp)
+			}
+
+			if got := a.limiter.Limit(); got != tt.wantLimit {
+				t.Errorf("got limit %v, want %v", got, tt.wantLimit)
+			}
+			if a.ceiling != tt.wantCeiling {
+				t.Errorf("got ceiling %v, want %v", a.ceiling, tt.wantCeiling)
+			}
+		})
+	}
+}
+
+func TestAdaptiveLimitReconfigure(t *testing.T) {
+	tests := []struct {
+		name        string
+		steps       []adaptiveStep
+		cfg         limitsConfig
+		wantLimit   rate.Limit
+		wantCeiling rate.Limit
+	}{
+		{"backoff survives a reload", []adaptiveStep{{0, rateLimited()}},
+			limitsConfig{Remote: limitConfig{Rate: 10, Burst: 20}, AdaptRemote: true}, 5, 10},
+		{"reported ceiling survives a higher limit", []adaptiveStep{{0, budget(300, 200)}},
+			limitsConfig{Remote: limitConfig{Rate: 20, Burst: 10}, AdaptRemote: true}, 5, 5},
+		{"lower limit replaces the reported ceiling", []adaptiveStep{{0, budget(300, 200)}},
+			limitsConfig{Remote: limitConfig{Rate: 3, Burst: 10}, AdaptRemote: true}, 3, 3},
+		{"higher limit without a reported ceiling", nil,
+			limitsConfig{Remote: limitConfig{Rate: 20, Burst: 10}, AdaptRemote: true}, 10, 20},
+		{"lower limit cuts the current one", nil,
+			limitsConfig{Remote: limitConfig{Rate: 4, Burst: 10}, AdaptRemote: true}, 4, 4},
+		{"disabling goes back to the configured limit", []adaptiveStep{{0, rateLimited()}},
+			limitsConfig{Remote: limitConfig{Rate: 10, Burst: 10}}, 10, 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAdaptiveLimit(10)
+			for _, step := range tt.steps {
+				a.advance(step.after)
+				a.observe(step.resp)
+			}
+
+			a.reconfigure(&tt.cfg)
+
+			if got := a.limiter.Limit(); got != tt.wantLimit {
+				t.Errorf("got limit %v, want %v", got, tt.wantLimit)
+			}
+			if a.ceiling != tt.wantCeiling {
+				t.Errorf("got ceiling %v, want %v", a.ceiling, tt.wantCeiling)
+			}
+			if got := a.limiter.Burst(); got != tt.cfg.Remote.Burst {
+				t.Errorf("got burst %v, want %v", got, tt.cfg.Remote.Burst)
+			}
+		})
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type queueWaiter struct {
+	ready chan struct{}
+}
+
+// upstreamQueue holds requests until the upstream limiter has room for them
+// Keys take turns so a single busy application can't starve everyone else
+type upstreamQueue struct {
+	name    string
+	limiter *rate.Limiter
+	maxSize int
+	maxWait time.Duration
+
+	mu      sync.Mutex
+	waiting map[string][]*queueWaiter
+	order   []string // keys with waiters, in the order they're served
+	size    int
+	wake    chan struct{}
+
+	ctx    context.Context
+	stopFn context.CancelFunc
+}
+
+func newUpstreamQueue(name string, limiter *rate.Limiter, maxSize int, maxWait time.Duration) *upstreamQueue {
+	q := &upstreamQueue{
+		name:    name,
+		limiter: limiter,
+		maxSize: maxSize,
+		maxWait: maxWait,
+		waiting: make(map[string][]*queueWaiter),
+		wake:    make(chan struct{}, 1),
+	}
+	q.ctx, q.stopFn = context.WithCancel(context.Background())
+	go q.dispatch()
+
+	return q
+}
+
+// configure applies changed queue settings, requests already waiting keep their place
+func (q *upstreamQueue) configure(maxSize int, maxWait time.Duration) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.maxSize = maxSize
+	q.maxWait = maxWait
+}
+
+func (q *upstreamQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.size
+}
+
+// enqueue also returns how long the waiter may wait, which can change on reloads
+func (q *upstreamQueue) enqueue(key string) (*queueWaiter, time.Duration, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.size >= q.maxSize || q.ctx.Err() != nil {
+		return nil, 0, false
+	}
+
+	w := &queueWaiter{ready: make(chan struct{})}
+	if len(q.waiting[key]) == 0 {
+		q.order = append(q.order, key)
+	}
+	q.waiting[key] = append(q.waiting[key], w)
+	q.size++
+	upstreamQueueDepth.WithLabelValues(q.name).Set(float64(q.size))
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+
+	return w, q.maxWait, true
+}
+
+// release lets the first waiter of the key whose turn it is go upstream
+func (q *upstreamQueue) release() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.order) == 0 {
+		return false
+	}
+
+	key := q.order[0]
+	q.order = q.order[1:]
+
+	waiters := q.waiting[key]
+	if len(waiters) > 1 {
+		q.waiting[key] = waiters[1:]
+		// Back of the line for the key's remaining requests
+		q.order = append(q.order, key)
+	} else {
+		delete(q.waiting, key)
+	}
+	q.size--
+	upstreamQueueDepth.WithLabelValues(q.name).Set(float64(q.size))
+
+	// Closed under the lock so cancel can tell whether the waiter made it
+	close(waiters[0].ready)
+	return true
+}
+
+// cancel takes a waiter out of the queue, false if it was released in the meantime
+func (q *upstreamQueue) cancel(key string, w *queueWaiter) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	waiters := q.waiting[key]
+	for i, other := range waiters {
+		if other != w {
+			continue
+		}
+
+		if len(waiters) == 1 {
+			delete(q.waiting, key)
+			for j, k := range q.order {
+				if k == key {
+					q.order = append(q.order[:j], q.order[j+1:]...)
+					break
+				}
+			}
+		} else {
+			q.waiting[key] = append(waiters[:i:i], waiters[i+1:]...)
+		}
+		q.size--
+		upstreamQueueDepth.WithLabelValues(q.name).Set(float64(q.size))
+		return true
+	}
+
+	return false
+}
+
+// stop ends the dispatcher, requests still waiting are turned away
+func (q *upstreamQueue) stop() {
+	q.stopFn()
+}
+
+func (q *upstreamQueue) dispatch() {
+	for {
+		select {
+		case <-q.wake:
+		case <-q.ctx.Done():
+			return
+		}
+
+		for q.len() > 0 {
+			res := limits.allow("remote", q.name, q.limiter)
+			if !res.Allowed {
+				wait := res.RetryAfter
+				if wait < 10*time.Millisecond {
+					wait = 10 * time.Millisecond
+				}
+				if !sleepContext(q.ctx, wait) {
+					return
+				}
+				continue
+			}
+
+			// Only if the last waiter gave up since the check above does the slot go unused
+			q.release()
+		}
+	}
+}
+
+// retryAfter estimates how long it takes until the queue has been worked off
+func (q *upstreamQueue) retryAfter() time.Duration {
+	q.mu.Lock()
+	size, maxWait := q.size, q.maxWait
+	q.mu.Unlock()
+
+	limit := q.limiter.Limit()
+	if limit <= 0 || limit == rate.Inf {
+		return maxWait
+	}
+	return time.Duration(float64(size+1) / float64(limit) * float64(time.Second))
+}
+
+// wait blocks until the request may go upstream or the wait isn't worth it anymore
+func (q *upstreamQueue) wait(ctx context.Context, key string) bool {
+	w, maxWait, ok := q.enqueue(key)
+	if !ok {
+		return false
+	}
+
+	timer := time.NewTimer(maxWait)
+	defer timer.Stop()
+
+	select {
+	case <-w.ready:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	case <-q.ctx.Done():
+	}
+
+	// It may have become ready while giving up
+	return !q.cancel(key, w)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// blockedLimiter never has room, so only the test releases waiters
+func blockedLimiter() *rate.Limiter {
+	return rate.NewLimiter(0, 0)
+}
+
+func TestUpstreamQueueOrder(t *testing.T) {
+	q := newUpstreamQueue("test", blockedLimiter(), 10, time.Minute)
+	defer q.stop()
+
+	type named struct {
+		name string
+		w    *queueWaiter
+	}
+	var waiters []named
+	for _, e := range []struct{ name, key string }{{"a1", "a"}, {"a2", "a"}, {"a3", "a"}, {"b1", "b"}, {"c1", "c"}, {"b2", "b"}} {
+		w, _, ok := q.enqueue(e.key)
+		if !ok {
+			t.Fatalf("couldn't enqueue %v", e.name)
+		}
+		waiters = append(waiters, named{e.name, w})
+	}
+
+	// Keys take turns, each key's requests keep their order
+	released := make(map[string]bool)
+	for _, want := range []string{"a1", "b1", "c1", "a2", "b2", "a3"} {
+		if !q.release() {
+			t.Fatalf("nothing released, want %v", want)
+		}
+
+		var got []string
+		for _, n := range waiters {
+			select {
+			case <-n.w.ready:
+				if !released[n.name] {
+					got = append(got, n.name)
+				}
+			default:
+			}
+		}
+		if len(got) != 1 || got[0] != want {
+			t.Fatalf("got %v released, want %v", got, want)
+		}
+		released[want] = true
+	}
+
+	if q.release() || q.len() != 0 {
+		t.Fatalf("queue should be empty, %v left", q.len())
+	}
+}
+
+func TestUpstreamQueueFull(t *testing.T) {
+	q := newUpstreamQueue("test", blockedLimiter(), 2, time.Minute)
+	defer q.stop()
+
+	for i := 0; i < 2; i++ {
+		if _, _, ok := q.enqueue("a"); !ok {
+			t.Fatalf("couldn't enqueue request %v", i)
+		}
+	}
+	if _, _, ok := q.enqueue("b"); ok {
+		t.Fatalf("enqueued into a full queue")
+	}
+}
+
+func TestUpstreamQueueCancel(t *testing.T) {
+	q := newUpstreamQueue("test", blockedLimiter(), 10, time.Minute)
+	defer q.stop()
+
+	first, _, _ := q.enqueue("a")
+	second, _, _ := q.enqueue("a")
+	other, _, _ := q.enqueue("b")
+
+	if !q.cancel("a", first) {
+		t.Fatalf("couldn't cancel a waiting request")
+	}
+	if q.len() != 2 {
+		t.Fatalf("got %v waiting, want 2", q.len())
+	}
+
+	// The key's remaining request is still first in line
+	q.release()
+	select {
+	case <-second.ready:
+	default:
+		t.Fatalf("the key's second request wasn't released")
+	}
+	if q.cancel("a", second) {
+		t.Fatalf("cancelled a request that was already released")
+	}
+
+	q.release()
+	select {
+	case <-other.ready:
+	default:
+		t.Fatalf("the other key's request wasn't released")
+	}
+	if q.len() != 0 {
+		t.Fatalf("got %v waiting, want none", q.len())
+	}
+}
+
+func TestUpstreamQueueWait(t *testing.T) {
+	tests := []struct {
+		name    string
+		limiter *rate.Limiter
+		maxWait time.Duration
+		cancel  bool
+		stop    bool
+		want    bool
+	}{
+		{"released", rate.NewLimiter(rate.Inf, 1), time.Minute, false, false, true},
+		{"max wait", blockedLimiter(), 20 * time.Millisecond, false, false, false},
+		{"client gave up", blockedLimiter(), time.Minute, true, false, false},
+		{"stopped", blockedLimiter(), time.Minute, false, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newUpstreamQueue("test", tt.limiter, 10, tt.maxWait)
+			defer q.stop()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				time.AfterFunc(20*time.Millisecond, cancel)
+			}
+			if tt.stop {
+				time.AfterFunc(20*time.Millisecond, q.stop)
+			}
+
+			if got := q.wait(ctx, "a"); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			if q.len() != 0 {
+				t.Fatalf("got %v waiting, want none", q.len())
+			}
+		})
+	}
+}
+
+func TestUpstreamQueueStopped(t *testing.T) {
+	q := newUpstreamQueue("test", blockedLimiter(), 10, time.Minute)
+	q.stop()
+
+	if _, _, ok := q.enqueue("a"); ok {
+		t.Fatalf("enqueued into a stopped queue")
+	}
+}
+
+func TestUpstreamQueueReload(t *testing.T) {
+	el := &endpointLimiters{
+		limiters: make(map[string]*rate.Limiter),
+		queues:   make(map[string]*upstreamQueue),
+		used:     make(map[string]bool),
+	}
+
+	cfg := limitConfig{Rate: 0.001, Burst: 1, QueueSize: 1, MaxWait: time.Second}
+	limiter := el.limiter("remote", "test", cfg)
+	// Use up the burst so nothing gets released during the test
+	limiter.Allow()
+	q := el.queue("test", limiter, cfg)
+	defer q.stop()
+	if _, _, ok := q.enqueue("a"); !ok {
+		t.Fatalf("couldn't enqueue")
+	}
+
+	cfg.QueueSize = 2
+	cfg.MaxWait = 2 * time.Second
+	reloaded := el.queue("test", el.limiter("remote", "test", cfg), cfg)
+	el.prune()
+	if reloaded != q {
+		t.Fatalf("reloading replaced the queue")
+	}
+	if q.len() != 1 {
+		t.Fatalf("got %v waiting after the reload, want 1", q.len())
+	}
+
+	_, maxWait, ok := q.enqueue("b")
+	if !ok || maxWait != 2*time.Second {
+		t.Fatalf("got enqueued %v with max wait %v, want the new settings", ok, maxWait)
+	}
+
+	// Dropping the endpoint's queue stops it
+	el.prune()
+	if _, _, ok := q.enqueue("c"); ok {
+		t.Fatalf("enqueued into a queue that was pruned")
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Usage is stored per key, endpoint and hour
+	usageBucketSize = time.Hour
+	usageRetention  = 400 * 24 * time.Hour
+	// Reports cover this long unless a range is given
+	usageDefaultRange = 30 * 24 * time.Hour
+)
+
+type usageBucketKey struct {
+	// Keys are identified by hash because cached responses are served before auth
+	keyHash string
+	handler string
+	start   time.Time
+}
+
+type usageCounts struct {
+	requests int64
+	cached   int64
+	upstream int64
+}
+
+type usageRecorder struct {
+	buckets map[usageBucketKey]*usageCounts
+	mu      sync.Mutex
+}
+
+var keyUsageBuckets = &usageRecorder{buckets: make(map[usageBucketKey]*usageCounts)}
+
+func (u *usageRecorder) record(keyHash string, handler string, cached bool, upstream bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	bucket := usageBucketKey{keyHash: keyHash, handler: handler, start: time.Now().UTC().Truncate(usageBucketSize)}
+	counts, exists := u.buckets[bucket]
+	if !exists {
+		counts = &usageCounts{}
+		u.buckets[bucket] = counts
+	}
+	counts.requests++
+	if cached {
+		counts.cached++
+	}
+	if upstream {
+		counts.upstream++
+	}
+}
+
+func (u *usageRecorder) take() map[usageBucketKey]*usageCounts {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	buckets := u.buckets
+	u.buckets = make(map[usageBucketKey]*usageCounts)
+	return buckets
+}
+
+// flush adds the recorded usage to the database, requests with unknown keys are dropped there
+func (u *usageRecorder) flush(db *sql.DB) {
+	for bucket, counts := range u.take() {
+		_, err := db.Exec("INSERT INTO key_usage (key_id, handler, bucket_start, requests, cached, upstream) "+
+			"SELECT id, $2, $3, $4, $5, $6 FROM api_keys WHERE key_hash = $1 "+
+			"ON CONFLICT (key_id, handler, bucket_start) DO UPDATE SET requests = key_usage.requests + EXCLUDED.requests, "+
+			"cached = key_usage.cached + EXCLUDED.cached, upstream = key_usage.upstream + EXCLUDED.upstream",
+			bucket.keyHash, bucket.handler, bucket.start, counts.requests, counts.cached, counts.upstream)
+		if err != nil {
+			logger.WithError(err).WithField("handler", bucket.handler).Error("Error saving usage")
+		}
+	}
+}
+
+func pruneUsage(db *sql.DB) error {
+	_, err := db.Exec("DELETE FROM key_usage WHERE bucket_start < $1", time.Now().Add(-usageRetention))
+	if err != nil {
+		return fmt.Errorf("error removing old usage. %v", err)
+	}
+	return nil
+}
+
+// apiUsage records which key used an endpoint, whether it was cached and if osu! was asked
+func apiUsage(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		key := c.GetHeader("api-key")
+		if key == "" {
+			return
+		}
+		// Only keys that exist, made up ones would pile up until the next flush
+		keyHash := hashKey(key)
+		if _, known := keyTiers.cached(keyHash); !known && c.GetInt64("keyID") == 0 {
+			return
+		}
+		keyUsageBuckets.record(keyHash, name, c.GetString("cache") == "hit", c.GetBool("upstream"))
+	}
+}
+
+type usageReportRow struct {
+	KeyID         int64   `json:"key_id"`
+	UserID        int64   `json:"user_id"`
+	Label         string  `json:"label"`
+	Handler       string  `json:"handler"`
+	Requests      int64   `json:"requests"`
+	Cached        int64   `json:"cached"`
+	Upstream      int64   `json:"upstream"`
+	CacheHitRatio float64 `json:"cache_hit_ratio"`
+}
+
+// usageReport sums up usage per key and endpoint, biggest consumers of the upstream budget first
+func usageReport(db *sql.DB, from time.Time, to time.Time) ([]usageReportRow, error) {
+	rows, err := db.Query("SELECT u.key_id, k.user_id, k.label, u.handler, SUM(u.requests), SUM(u.cached), SUM(u.upstream) "+
+		"FROM key_usage u JOIN api_keys k ON k.id = u.key_id WHERE u.bucket_start >= $1 AND u.bucket_start < $2 "+
+		"GROUP BY u.key_id, k.user_id, k.label, u.handler ORDER BY SUM(u.upstream) DESC, SUM(u.requests) DESC", from, to)
+	if err != nil {
+		return nil, fmt.Errorf("error querying database. %v", err)
+	}
+	defer rows.Close()
+
+	report := []usageReportRow{}
+	for rows.Next() {
+		var row usageReportRow
+		if err = rows.Scan(&row.KeyID, &row.UserID, &row.Label, &row.Handler, &row.Requests, &row.Cached, &row.Upstream); err != nil {
+			return nil, fmt.Errorf("couldn't scan usage %v", err)
+		}
+		if row.Requests > 0 {
+			row.CacheHitRatio = float64(row.Cached) / float64(row.Requests)
+		}
+		report = append(report, row)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading usage. %v", err)
+	}
+
+	return report, nil
+}
+
+// parseReportTime accepts dates as well as full timestamps
+func parseReportTime(value string, fallback time.Time) (time.Time, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func usageReportRange(c *gin.Context) (time.Time, time.Time, error) {
+	now := time.Now().UTC()
+	to, err := parseReportTime(c.Query("to"), now)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid to, use YYYY-MM-DD or RFC 3339")
+	}
+	from, err := parseReportTime(c.Query("from"), to.Add(-usageDefaultRange))
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid from, use YYYY-MM-DD or RFC 3339")
+	}
+	if !from.Before(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from has to be before to")
+	}
+	return from, to, nil
+}
+
+func usageReportHandler(db *sql.DB, asCSV bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		from, to, err := usageReportRange(c)
+		if err != nil {
+			c.String(http.StatusBadRequest, err.Error())
+			return
+		}
+
+		// Include what hasn't been flushed yet
+		keyUsageBuckets.flush(db)
+		report, err := usageReport(db, from, to)
+		if err != nil {
+			requestLog(c).WithError(err).Error("Error creating usage report")
+			c.String(http.StatusInternalServerError, "Couldn't create usage report")
+			return
+		}
+
+		if !asCSV {
+			c.JSON(http.StatusOK, gin.H{"from": from, "to": to, "usage": report})
+			return
+		}
+
+		c.Header("Content-Type", "text/csv")
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=\"usage-%v-%v.csv\"", from.Format("20060102"), to.Format("20060102")))
+		w := csv.NewWriter(c.Writer)
+		w.Write([]string{"key_id", "user_id", "label", "handler", "requests", "cached", "upstream", "cache_hit_ratio"})
+		for _, row := range report {
+			w.Write([]string{
+				strconv.FormatInt(row.KeyID, 10),
+				strconv.FormatInt(row.UserID, 10),
+				row.Label,
+				row.Handler,
+				strconv.FormatInt(row.Requests, 10),
+				strconv.FormatInt(row.Cached, 10),
+				strconv.FormatInt(row.Upstream, 10),
+				strconv.FormatFloat(row.CacheHitRatio, 'f', 4, 64),
+			})
+		}
+		w.Flush()
+	}
+}
@@ -2,13 +2,22 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"database/sql"
+	"encoding/hex"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
 )
 
 const chars = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 
+const keyPrefixLength = 8
+
 func randomString(length int) (string, error) {
 	bytes := make([]byte, length-1)
 
@@ -23,32 +32,144 @@ func randomString(length int) (string, error) {
 	return string(bytes), nil
 }
 
-func keyToToken(key string, db *sql.DB) (string, error) {
-	rows, err := db.Query("SELECT accessToken FROM api_tokens WHERE api_key=$1 LIMIT 1", key)
+// Keys are long random strings, so a fast hash is sufficient to protect them
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// The prefix is stored in clear text so keys can be identified and looked up
+func keyPrefix(key string) string {
+	if len(key) < keyPrefixLength {
+		return key
+	}
+	return key[:keyPrefixLength]
+}
+
+// keyInfo is what an api key resolves to
+type keyInfo struct {
+	id     int64
+	userID int64
+	token  string
+}
+
+func lookupKey(key string, db *sql.DB) (*keyInfo, error) {
+	hash := hashKey(key)
+
+	rows, err := db.Query("SELECT k.id, k.user_id, k.key_hash, t.accessToken, t.revoked FROM api_keys k "+
+		"JOIN api_tokens t ON t.id = k.user_id WHERE k.key_prefix=$1 AND (k.revoked_at IS NULL OR k.revoked_at > now()) AND (k.expires_at IS NULL OR k.expires_at > now())", keyPrefix(key))
 	if err != nil {
-		return "", fmt.Errorf("error querying database. %v", err)
+		return nil, fmt.Errorf("error querying database. %v", err)
 	}
 	defer rows.Close()
 
-	if !rows.Next() {
-		return "", fmt.Errorf("no token found")
+	for rows.Next() {
+		var (
+			info       keyInfo
+			storedHash string
+			revoked    bool
+		)
+		if err = rows.Scan(&info.id, &info.userID, &storedHash, &info.token, &revoked); err != nil {
+			return nil, fmt.Errorf("couldn't scan token %v", err)
+		}
+
+		if subtle.ConstantTimeCompare([]byte(storedHash), []byte(hash)) == 1 {
+			return decryptKeyInfo(&info, revoked)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("error reading tokens. %v", err)
 	}
 
-	var token string
-	if err = rows.Scan(&token); err != nil {
-		return token, fmt.Errorf("couldn't scan token %v", err)
+	return migrateLegacyKey(key, db)
+}
+
+func decryptKeyInfo(info *keyInfo, revoked bool) (*keyInfo, error) {
+	if revoked {
+		return nil, fmt.Errorf("token revoked")
+	}
+
+	token, err := tokenCrypt.decrypt(info.token)
+	if err != nil {
+		return nil, err
+	}
+	info.token = token
+
+	return info, nil
+}
+
+// moveLegacyKey moves a key that is still stored in clear text in api_tokens to api_keys as a hash
+func moveLegacyKey(key string, db *sql.DB) (*keyInfo, bool, error) {
+	var (
+		info    keyInfo
+		revoked bool
+	)
+	// Like createKey, the tokens are refreshed right away if the user went dormant
+	err := db.QueryRow("WITH legacy AS (UPDATE api_tokens SET api_key=NULL, dormant=FALSE, "+
+		"nextRefresh=CASE WHEN dormant THEN now() ELSE nextRefresh END WHERE api_key=$1 RETURNING id, accessToken, revoked), "+
+		"inserted AS (INSERT INTO api_keys (user_id,label,key_prefix,key_hash) SELECT id,$2,$3,$4 FROM legacy RETURNING id, user_id) "+
+		"SELECT inserted.id, inserted.user_id, legacy.accessToken, legacy.revoked FROM inserted JOIN legacy ON legacy.id = inserted.user_id",
+		key, defaultKeyLabel, keyPrefix(key), hashKey(key)).Scan(&info.id, &info.userID, &info.token, &revoked)
+	if err == sql.ErrNoRows {
+		return nil, false, fmt.Errorf("no token found")
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("error migrating key. %v", err)
+	}
+
+	return &info, revoked, nil
+}
+
+// migrateLegacyKey hashes a key that is still stored in clear text on first use
+func migrateLegacyKey(key string, db *sql.DB) (*keyInfo, error) {
+	info, revoked, err := moveLegacyKey(key, db)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.WithField("key_prefix", keyPrefix(key)).Info("Migrated legacy key")
+	keysMigrated.Inc()
+
+	return decryptKeyInfo(info, revoked)
+}
+
+func hashLegacyKeys(db *sql.DB) (int, error) {
+	rows, err := db.Query("SELECT api_key FROM api_tokens WHERE api_key IS NOT NULL")
+	if err != nil {
+		return 0, fmt.Errorf("error querying database. %v", err)
+	}
+
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err = rows.Scan(&key); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("couldn't scan key %v", err)
+		}
+		keys = append(keys, strings.TrimSpace(key))
 	}
-	return token, nil
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, fmt.Errorf("error reading keys. %v", err)
+	}
+
+	for _, key := range keys {
+		if _, _, err = moveLegacyKey(key, db); err != nil {
+			return 0, fmt.Errorf("couldn't save key hash of %v. %v", keyPrefix(key), err)
+		}
+	}
+
+	return len(keys), nil
 }
 
-func keyExists(key string, db *sql.DB) (bool, error) {
+func keyExists(key string, db queryer) (bool, error) {
 	var keyCount int
-	err := db.QueryRow("SELECT COUNT(*) FROM api_tokens WHERE api_key = $1 LIMIT 1", key).Scan(&keyCount)
+	err := db.QueryRow("SELECT (SELECT COUNT(*) FROM api_keys WHERE key_hash = $1) + (SELECT COUNT(*) FROM api_tokens WHERE api_key = $2)", hashKey(key), key).Scan(&keyCount)
 	if err != nil {
 		return false, fmt.Errorf("error checking database. %v", err)
 	}
 
-	return keyCount == 1, nil
+	return keyCount > 0, nil
 }
 
 func userExists(id int64, db *sql.DB) (bool, error) {
@@ -61,17 +182,7 @@ func userExists(id int64, db *sql.DB) (bool, error) {
 	return count == 1, nil
 }
 
-func userKey(id int64, db *sql.DB) (string, error) {
-	var key string
-	err := db.QueryRow("SELECT api_key FROM api_tokens WHERE id = $1 LIMIT 1", id).Scan(&key)
-	if err != nil {
-		return key, fmt.Errorf("error checking database. %v", err)
-	}
-
-	return key, nil
-}
-
-func uniqueKey(db *sql.DB) (string, error) {
+func uniqueKey(db queryer) (string, error) {
 	for {
 		key, err := randomString(64)
 		if err != nil {
@@ -89,56 +200,80 @@ func uniqueKey(db *sql.DB) (string, error) {
 	}
 }
 
+func encryptTokens(accessToken string, refreshToken string) (string, string, error) {
+	accessToken, err := tokenCrypt.encrypt(accessToken)
+	if err != nil {
+		return "", "", fmt.Errorf("error encrypting access token. %v", err)
+	}
+
+	refreshToken, err = tokenCrypt.encrypt(refreshToken)
+	if err != nil {
+		return "", "", fmt.Errorf("error encrypting refresh token. %v", err)
+	}
+
+	return accessToken, refreshToken, nil
+}
+
 func updateTokens(db *sql.DB, expiryTime time.Time, accessToken string, refreshToken string, id int64) error {
-	stmt, err := db.Prepare("UPDATE api_tokens SET expiryTime=$1,accessToken=$2,refreshToken=$3 WHERE id=$4")
+	accessToken, refreshToken, err := encryptTokens(accessToken, refreshToken)
+	if err != nil {
+		return err
+	}
+
+	stmt, err := db.Prepare("UPDATE api_tokens SET expiryTime=$1,accessToken=$2,refreshToken=$3,nextRefresh=$4,refreshFailures=0,revoked=FALSE,dormant=FALSE WHERE id=$5")
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(expiryTime, accessToken, refreshToken, id)
+	_, err = stmt.Exec(expiryTime, accessToken, refreshToken, nextRefreshTime(expiryTime), id)
 	if err != nil {
 		return err
 	}
+
+	// Newer tokens from signing in again replace any that couldn't be saved earlier
+	takeUnsavedToken(id)
 	return nil
 }
 
-func refreshTokens(db *sql.DB, cfg *osuAPIConfig) {
-	fmt.Println("Refreshing tokens...")
-	rows, err := db.Query("SELECT id, refreshToken FROM api_tokens")
+// deleteUser revokes the user's token upstream and removes everything stored about them
+func deleteUser(db *sql.DB, cache *clientv3.Client, id int64) error {
+	var token string
+	err := db.QueryRow("SELECT accessToken FROM api_tokens WHERE id = $1", id).Scan(&token)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("no such user")
+	}
 	if err != nil {
-		fmt.Println("Error refreshing tokens", err)
-		return
+		return fmt.Errorf("error checking database. %v", err)
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var (
-			id            int64
-			refreshTokens string
-		)
-		if err = rows.Scan(&id, &refreshTokens); err != nil {
-			fmt.Println("Error getting old token to refresh", err)
-			continue
-		}
+	// Cached responses may be keyed by name as well as by id
+	userIdentifiers := []string{strconv.FormatInt(id, 10)}
 
-		token, err := refreshToken(cfg, refreshTokens)
-		if err != nil {
-			fmt.Println("Error refreshing token", err)
-			continue
+	// The token may have expired or been revoked already, which shouldn't prevent deletion
+	if token, err = tokenCrypt.decrypt(token); err != nil {
+		logger.WithError(err).WithField("user_id", id).Warn("Couldn't decrypt token of deleted user")
+	} else {
+		if user, err := getCurrentUser(token); err == nil && user.Username != "" {
+			userIdentifiers = append(userIdentifiers, user.Username)
 		}
+		if err = revokeToken(token); err != nil {
+			logger.WithError(err).WithField("user_id", id).Warn("Couldn't revoke token of deleted user")
+		}
+	}
 
-		expiryTime := time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
-		updateTokens(db, expiryTime, token.AccessToken, token.RefreshToken, id)
-		time.Sleep(time.Second)
+	// Keys and sessions are removed by cascade
+	_, err = db.Exec("DELETE FROM api_tokens WHERE id = $1", id)
+	if err != nil {
+		return fmt.Errorf("error deleting user. %v", err)
 	}
-}
+	usersRegistered.Dec()
 
-func refreshTokensRoutine(db *sql.DB, cfg *osuAPIConfig) {
-	for {
-		go refreshTokens(db, cfg)
-		time.Sleep(time.Hour * 23)
+	if err = purgeUserCache(cache, userIdentifiers...); err != nil {
+		return fmt.Errorf("user deleted, but failed to purge cache. %v", err)
 	}
+
+	return nil
 }
 
 func getUserCount(db *sql.DB) (int, error) {